@@ -0,0 +1,107 @@
+//go:build gss
+
+/****************************************************************
+* Pgbouncer Exporter: GSSAPI (kerberos) authentication
+* Built only with `-tags gss`, as kerberos brings in gokrb5
+****************************************************************/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/lib/pq"
+)
+
+func init() {
+	GSSProvider = registerGSS
+}
+
+// registerGSS registers kerberos provider of lib/pq, which logins with keytab if given,
+// or credential cache (KRB5CCNAME, e.g. obtained by kinit) otherwise
+func registerGSS(keytabFile, principal string) error {
+	cfgPath := "/etc/krb5.conf"
+	if p, exists := os.LookupEnv("KRB5_CONFIG"); exists {
+		cfgPath = p
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return fmt.Errorf("fail to load kerberos config %s: %w", cfgPath, err)
+	}
+	if keytabFile == "" {
+		pq.RegisterGSSProvider(func() (pq.GSS, error) {
+			// credential cache is loaded on each connect, so tickets renewed by kinit are picked up
+			ccache, err := credentials.LoadCCache(ccachePath())
+			if err != nil {
+				return nil, fmt.Errorf("fail to load kerberos credential cache: %w", err)
+			}
+			cl, err := client.NewFromCCache(ccache, cfg, client.DisablePAFXFAST(true))
+			if err != nil {
+				return nil, fmt.Errorf("kerberos login with credential cache failed: %w", err)
+			}
+			return &krbGSS{client: cl}, nil
+		})
+		return nil
+	}
+	username, realm, found := strings.Cut(principal, "@")
+	if !found || username == "" || realm == "" {
+		return fmt.Errorf("invalid principal %q, should be user@REALM", principal)
+	}
+	kt, err := keytab.Load(keytabFile)
+	if err != nil {
+		return fmt.Errorf("fail to load keytab %s: %w", keytabFile, err)
+	}
+	pq.RegisterGSSProvider(func() (pq.GSS, error) {
+		cl := client.NewWithKeytab(username, realm, kt, cfg, client.DisablePAFXFAST(true))
+		if err := cl.Login(); err != nil {
+			return nil, fmt.Errorf("kerberos login as %s failed: %w", principal, err)
+		}
+		return &krbGSS{client: cl}, nil
+	})
+	return nil
+}
+
+// ccachePath returns file path of credential cache: KRB5CCNAME (FILE: type only) or /tmp/krb5cc_<uid> by default
+func ccachePath() string {
+	if name := os.Getenv("KRB5CCNAME"); name != "" {
+		return strings.TrimPrefix(name, "FILE:")
+	}
+	return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+}
+
+// krbGSS implements pq.GSS with a logged in gokrb5 client
+type krbGSS struct {
+	client *client.Client
+}
+
+// GetInitToken implements pq.GSS, spn is service/host
+func (g *krbGSS) GetInitToken(host string, service string) ([]byte, error) {
+	return g.GetInitTokenFromSpn(service + "/" + host)
+}
+
+// GetInitTokenFromSpn implements pq.GSS
+func (g *krbGSS) GetInitTokenFromSpn(spn string) ([]byte, error) {
+	token, err := spnego.SPNEGOClient(g.client, spn).InitSecContext()
+	if err != nil {
+		return nil, fmt.Errorf("kerberos error (InitSecContext): %w", err)
+	}
+	return token.Marshal()
+}
+
+// Continue implements pq.GSS, authentication is done in one round trip
+func (g *krbGSS) Continue(inToken []byte) (done bool, outToken []byte, err error) {
+	var token spnego.SPNEGOToken
+	if err = token.Unmarshal(inToken); err != nil {
+		return true, nil, fmt.Errorf("kerberos error (Unmarshal token): %w", err)
+	}
+	if state := token.NegTokenResp.State(); state != spnego.NegStateAcceptCompleted {
+		return true, nil, fmt.Errorf("kerberos: expected state accept completed, got %d", state)
+	}
+	return true, nil, nil
+}
@@ -0,0 +1,191 @@
+//go:build integration
+
+/****************************************************************
+* Pgbouncer Exporter: integration test against real pgbouncer
+* Run with `go test -tags integration -run Integration ./...`
+* pgbouncer image is given by PGBOUNCER_IMAGE, requires docker
+****************************************************************/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// startPgbouncer starts postgres and pgbouncer (PGBOUNCER_IMAGE, edoburu/pgbouncer:latest by default) in docker
+// and returns host:port of pgbouncer, containers are removed when test finishes
+func startPgbouncer(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	image := os.Getenv("PGBOUNCER_IMAGE")
+	if image == "" {
+		image = "edoburu/pgbouncer:latest"
+	}
+	postgresImage := os.Getenv("POSTGRES_IMAGE")
+	if postgresImage == "" {
+		postgresImage = "postgres:16-alpine"
+	}
+	t.Logf("testing against %s", image)
+
+	nw, err := network.New(ctx)
+	if err != nil {
+		t.Fatalf("fail to create docker network: %s", err)
+	}
+	t.Cleanup(func() { nw.Remove(context.Background()) })
+
+	start := func(req testcontainers.ContainerRequest) testcontainers.Container {
+		c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{ContainerRequest: req, Started: true})
+		if c != nil {
+			t.Cleanup(func() { c.Terminate(context.Background()) })
+		}
+		if err != nil {
+			t.Fatalf("fail to start %s: %s", req.Image, err)
+		}
+		return c
+	}
+	start(testcontainers.ContainerRequest{
+		Image:          postgresImage,
+		Env:            map[string]string{"POSTGRES_PASSWORD": "postgres"},
+		Networks:       []string{nw.Name},
+		NetworkAliases: map[string][]string{nw.Name: {"postgres"}},
+		WaitingFor:     wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(time.Minute),
+	})
+	pgbouncer := start(testcontainers.ContainerRequest{
+		Image: image,
+		Env: map[string]string{
+			"DB_HOST":     "postgres",
+			"DB_USER":     "postgres",
+			"DB_PASSWORD": "postgres",
+			"AUTH_TYPE":   "scram-sha-256",
+			"ADMIN_USERS": "postgres",
+			"POOL_MODE":   "transaction",
+		},
+		ExposedPorts: []string{"5432/tcp"},
+		Networks:     []string{nw.Name},
+		WaitingFor:   wait.ForListeningPort("5432/tcp").WithStartupTimeout(time.Minute),
+	})
+	host, err := pgbouncer.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := pgbouncer.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s:%s", host, port.Port())
+}
+
+// generateTraffic runs queries through pgbouncer, so stats & pools are not empty
+func generateTraffic(t *testing.T, ctx context.Context, addr string) {
+	t.Helper()
+	db, err := sql.Open("postgres", fmt.Sprintf("postgres://postgres:postgres@%s/postgres?sslmode=disable", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(time.Second) {
+		if err = db.PingContext(ctx); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("pgbouncer is not ready: %s", err)
+	}
+	if _, err := db.ExecContext(ctx, `SELECT pg_sleep(0.1)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// integrationSamples maps `name{label="value",...}` (labels in exposition order) to value of gathered metrics
+func integrationSamples(t *testing.T, e *Exporter) map[string]float64 {
+	t.Helper()
+	registry, err := NewRegistry(nil, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples map[string]float64
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(time.Second) {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = make(map[string]float64)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				var labels []string
+				for _, l := range m.GetLabel() {
+					labels = append(labels, l.GetName()+`="`+l.GetValue()+`"`)
+				}
+				key := family.GetName()
+				if len(labels) > 0 {
+					key += "{" + strings.Join(labels, ",") + "}"
+				}
+				switch {
+				case m.Gauge != nil:
+					samples[key] = m.GetGauge().GetValue()
+				case m.Counter != nil:
+					samples[key] = m.GetCounter().GetValue()
+				case m.Untyped != nil:
+					samples[key] = m.GetUntyped().GetValue()
+				}
+			}
+		}
+		if samples["pgbouncer_up"] == 1 || time.Now().After(deadline) {
+			return samples
+		}
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	ctx := context.Background()
+	addr := startPgbouncer(t, ctx)
+	generateTraffic(t, ctx, addr)
+
+	e := NewExporter(fmt.Sprintf("postgres://postgres:postgres@%s/pgbouncer?sslmode=disable", addr))
+	if err := e.RegisterDescriptors(); err != nil {
+		t.Fatal(err)
+	}
+	samples := integrationSamples(t, e)
+
+	// check fails if no sample of given metric name, or name with leading labels e.g. `name{datname="x"`, satisfies the condition
+	check := func(description, series string, condition func(float64) bool) {
+		t.Helper()
+		for key, v := range samples {
+			name, _, _ := strings.Cut(key, "{")
+			if (name == series || strings.Contains(series, "{") && strings.HasPrefix(key, series)) && condition(v) {
+				return
+			}
+		}
+		t.Errorf("%s: no %s satisfies the condition", description, series)
+	}
+	present := func(float64) bool { return true }
+	check("pgbouncer is up", "pgbouncer_up", func(v float64) bool { return v == 1 })
+	check("lists: databases counted", "pgbouncer_databases", func(v float64) bool { return v >= 2 })
+	check("lists: used clients counted", "pgbouncer_used_clients", func(v float64) bool { return v >= 1 })
+	check("mem: memory usage reported", "pgbouncer_memory_usage", func(v float64) bool { return v > 0 })
+	check("stats: transactions counted", `pgbouncer_stat_total_xact_count{datname="postgres"`, func(v float64) bool { return v >= 1 })
+	check("stats: query time is positive", `pgbouncer_stat_total_query_time{datname="postgres"`, func(v float64) bool { return v > 0 })
+	check("databases: postgres listed", `pgbouncer_database_max_connections{datname="postgres"`, present)
+	check("databases: not paused", `pgbouncer_database_paused{datname="postgres"`, func(v float64) bool { return v == 0 })
+	check("pools: pool of postgres exists", `pgbouncer_pool_cl_active{datname="postgres",user="postgres"`, present)
+	check("pools: maxwait is sane", `pgbouncer_pool_maxwait_seconds{datname="postgres"`, func(v float64) bool { return v >= 0 && v < 60 })
+	check("pools: health is in [0,1]", `pgbouncer_pool_health{datname="postgres"`, func(v float64) bool { return v >= 0 && v <= 1 })
+	check("config: saturation is derived", "pgbouncer_client_connections_saturation", func(v float64) bool { return v > 0 && v < 1 })
+	for key, v := range samples {
+		if strings.HasPrefix(key, "pgbouncer_") && math.IsNaN(v) {
+			t.Errorf("no column drift: %s is NaN", key)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics: %v", samples)
+	}
+}
@@ -7,418 +7,2568 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // -pgbouncer-timezone works without zoneinfo of host, e.g. in scratch image
 
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 // Version 0.0.1
 var Version = "0.0.1"
 
+// metric namespace and subsystems
+const (
+	namespace         = "pgbouncer"
+	subsystemScrape   = "scrape"
+	subsystemMemory   = "memory"
+	subsystemStat     = "stat"
+	subsystemDatabase = "database"
+	subsystemPool     = "pool"
+	subsystemPeer     = "peer"
+	subsystemPeerPool = "peer_pool"
+)
+
 var (
 	listenAddress  string
 	metricPath     string
 	dataSourceName string
+	scrapeTimeout  time.Duration
+	stmtTimeout    time.Duration
+	enableConfig   bool
+	enableClock    bool
+	enableServers  bool
+	pgbouncerTZ    string
+	enablePeers    bool
+	nativeHisto    bool
+	heartbeat      bool
+	deltaExpose    bool
+	deltaFullEvery int
+	upOnly         bool
+	roundDecimals  int
+	maxOpenConns   int
+	maxIdleConns   int
+	helpFile       string
+	noLandingPage  bool
+	routePrefix    string
+	workers        string
+	enablePprof    bool
+	appName        string
+	hashLabels     bool
+	hashSalt       string
+	socketLabel    bool
+	emitUnused     bool
+	emitDeltas     bool
+	failOnReset    bool
+	errorHandling  string
+	constLabels    = make(labelsFlag)
+	renameMetrics  = make(renameFlag)
+	shardPaths     = make(shardFlag)
+	role           string
+	bindLocalhost  bool
+	maxScrapes     int
+	suppressZero   bool
+	memoryLimit    int64
+	noUserLabel    bool
+	datnameRegex   string
+	datnameReplace string
+	legacyPath     bool
+	includeUsers   string
+	infoColumns    string
+	excludeUsers   string
+	watchFailures  int
+	watchWindow    time.Duration
+	stdoutInterval time.Duration
+	outputFormat   string
+	influxURL      string
+	nativeURL      string
+	timeGather     bool
+	sampleSize     int
+	scrapeEndpoint bool
+	tlsServerName  string
+	tlsCA          string
+	tlsCert        string
+	tlsKey         string
+	tlsInsecure    bool
+	gssAuth        bool
+	gssKeytab      string
+	gssPrincipal   string
+	gssSrvName     string
+	gssSPN         string
+)
+
+// Collector groups, each one corresponding to a `SHOW` command
+var collectorGroups = []string{"lists", "config", "mem", "stats", "databases", "pools", "clock", "servers", "peers", "peer_pools"}
+
+// keyColumnCollectors are collectors whose key column (used as datname / type label) can be overridden
+var keyColumnCollectors = []string{"mem", "stats", "databases", "pools"}
+
+// keyColumnOverrides hold per-collector key column overrides, empty means use default key column
+var keyColumnOverrides = make(map[string]*string, len(keyColumnCollectors))
+
+// default key column of each collector, which is the first column of standard pgbouncer
+var defaultKeyColumns = map[string]string{
+	"mem":       "name",
+	"stats":     "database",
+	"databases": "name",
+	"pools":     "database",
+}
+
+// metric columns of `SHOW STATS`, `SHOW DATABASES`, `SHOW POOLS`, metric name is column name with subsystem prefix
+// columns of `SHOW STATS_AVERAGES` are mapped to avg columns of `SHOW STATS`
+var (
+	statColumns        = []string{"total_xact_count", "total_query_count", "total_received", "total_sent", "total_xact_time", "total_query_time", "total_wait_time", "avg_xact_count", "avg_query_count", "avg_recv", "avg_sent", "avg_xact_time", "avg_query_time", "avg_wait_time"}
+	statAverageColumns = map[string]string{"xact_count": "avg_xact_count", "query_count": "avg_query_count", "bytes_received": "avg_recv", "bytes_sent": "avg_sent", "xact_time": "avg_xact_time", "query_time": "avg_query_time", "wait_time": "avg_wait_time"}
+	databaseColumns    = []string{"pool_size", "reserve_pool", "max_connections", "current_connections", "paused", "disabled"}
+	poolColumns        = []string{"cl_active", "cl_waiting", "cl_cancel_req", "cl_active_cancel_req", "cl_waiting_cancel_req", "sv_active", "sv_active_cancel", "sv_being_canceled", "sv_idle", "sv_used", "sv_tested", "sv_login", "maxwait", "maxwait_us"}
+	peerColumns        = []string{"pool_size"}
+	peerPoolColumns    = []string{"cl_active_cancel_req", "cl_waiting_cancel_req", "sv_active_cancel", "sv_login"}
 )
 
+// poolModes are values of pgbouncer pool_mode, exposed as enum by pgbouncer_pool_mode
+var poolModes = []string{"session", "transaction", "statement"}
+
+// infoSubsystems are collectors whose string columns could be exposed as info metrics, mapped to metric subsystem
+var infoSubsystems = map[string]string{"databases": subsystemDatabase, "pools": subsystemPool}
+
+// probeCommands are optional show commands probed once per connection, to expose capabilities of target
+var probeCommands = []string{"version", "totals", "stats_totals", "stats_averages", "state", "users", "clients", "servers", "dns_hosts", "peers", "peer_pools"}
+
+// collectorTimeouts hold per-collector timeout overrides, zero means use global timeout
+var collectorTimeouts = make(map[string]*time.Duration, len(collectorGroups))
+
 // Exporter collect pgbouncer metrics, and implement prometheus.Collector
 type Exporter struct {
 	DB   *sql.DB
 	Desc map[string]*prometheus.Desc
 	dsn  string
 	rw   sync.Mutex
+	opts []ExporterOpt // options of NewExporter & Reload, which build shadow exporter of debug scrape
+
+	// custom tls config, negotiated by tlsDialer instead of lib/pq sslmode
+	tlsConfig *tls.Config
+
+	// application_name of connection if dsn does not have one
+	appName string
+
+	// connection pool size of DB, both 1 by default which makes queries strictly serial
+	maxOpen int
+	maxIdle int
+
+	// constant labels attached to every metric
+	constLabels prometheus.Labels
+
+	// metric name mapping: original name -> new name, applied when registering descriptors
+	renames map[string]string
+
+	// help text overrides: original name -> help, applied when registering descriptors
+	helps map[string]string
+
+	// scrape timeouts
+	timeout  time.Duration            // global timeout for each collector, 0 means no timeout
+	timeouts map[string]time.Duration // per-collector timeout overrides
+
+	// statement_timeout set on connect, 0 means not set
+	statementTimeout time.Duration
+
+	// key column of each collector, used as datname (or type for mem) label
+	keyColumns map[string]string
+
+	// string columns exposed as info metrics: collector -> columns
+	infoColumns map[string][]string
+
+	// glob patterns of users whose pools are scraped, exclude takes precedence over include
+	includeUsers []string
+	excludeUsers []string
+
+	// memory limit in bytes that memory total is compared to, 0 means no limit
+	memoryLimit int64
+
+	// skip pool metrics if every counter of the pool is zero
+	suppressZeroPools bool
+
+	// drop user label of pool metrics, pools of same database are aggregated
+	noUserLabel bool
+
+	// datname normalization: regex & replacement, metrics of same normalized datname are summed up
+	datnameRegex   *regexp.Regexp
+	datnameReplace string
+
+	// collectors in scrape order, builtin ones followed by those added by WithCollector
+	collectorList []Collector
+
+	// optional collectors
+	collectors    map[string]bool // collector groups to scrape, nil means all
+	disableConfig bool            // skip `SHOW CONFIG` and metrics derived from it
+	enableClock   bool            // measure clock skew with `SHOW CLIENTS`
+	enableServers bool            // aggregate server connections of `SHOW SERVERS` by pool
+	location      *time.Location  // time zone of pgbouncer, which resolves zone abbreviations of its timestamps
+	zoneUnknown   bool            // unresolvable zone abbreviation is logged once
+	disablePeers  bool            // skip `SHOW PEERS` and `SHOW PEER_POOLS`
+	noPeering     bool            // pgbouncer does not support peering (before 1.21), reset on connect
+	hashSalt      string          // salt of datname & user label hashing, disabled if empty
+	supported     map[string]bool // probed show commands: command -> supported, nil until probed, reset on connect
+	emitUnused    bool            // emit pgbouncer_database_unused from show databases & show stats
+	emitDeltas    bool            // emit change of total_* stats since previous scrape
+	failOnReset   bool            // fail the scrape when a counter reset of total_* stats is detected
+	nativeHisto   bool            // use native histograms instead of classic buckets
+	heartbeat     bool            // emit pgbouncer_exporter_heartbeat_total on every scrape
+	upOnly        bool            // liveness only: ping instead of show commands, expose pgbouncer_up & scrape metrics only
+
+	waitHistogram prometheus.Histogram // maxwait of pools with waiting clients, observed on each scrape
+
+	// raw results of current scrape, used for derived metrics, nil if the collector is disabled or failed
+	lists        map[string]float64 // `SHOW LISTS` result: list name -> count
+	config       map[string]string  // `SHOW CONFIG` result: key -> value
+	poolSizes    map[string]float64 // `SHOW DATABASES` result: datname -> effective pool_size, 0 if unknown
+	activity     map[string]float64 // `SHOW STATS` result: datname -> total_xact_count + total_query_count
+	poolTotals   map[string]float64 // `SHOW POOLS` result: column -> sum of all pools
+	poolRows     int                // rows of `SHOW POOLS`
+	databaseRows int                // rows of `SHOW DATABASES`
+	mismatched   bool               // topology mismatch in previous scrape, to log only when it begins
+	pidUnread    bool               // pidfile could not be read in previous scrape, to log only when it begins
+
+	// round-robin sampling of databases, disabled if sampleSize is 0
+	sampleSize   int
+	sampleOffset int             // index of first database of the window in sorted sampleNames
+	sampleNames  []string        // sorted database names from last `SHOW DATABASES`
+	sample       map[string]bool // databases sampled in current scrape, nil means all
 
 	// internal state
-	pgbouncerUp    bool
-	scrapeDuration time.Duration
-	lastScrape     time.Time
-	totalScrapes   int64
-	errorCount     int64
+	pgbouncerUp      bool
+	scrapeDuration   time.Duration
+	queueWait        time.Duration // time that current scrape waited for previous one to finish
+	lastScrape       time.Time
+	totalScrapes     int64
+	heartbeats       int64 // scrapes started, whatever the result
+	errorCount       int64
+	goroutines       int64 // scrape goroutines still running, including those draining after timeout
+	reconnects       int64
+	connectedAt      time.Time                 // time of last successful Connect, reset on reconnect
+	queryErrors      map[queryErrorKey]float64 // failed show commands by collector & sqlstate
+	consoleChecked   bool                      // whether target has been checked as pgbouncer admin console
+	privilegeChecked bool                      // whether privileges have been checked on connect
+	privileged       bool                      // whether user could run show stats, checked on connect
+	reloadFailed     bool                      // whether last reload on SIGHUP failed, previous config is kept then
+	reloadedAt       time.Time                 // time of startup or last successful reload
+	duplicatePools   int64                     // duplicate (datname, user) rows skipped in show pools
+	results          []CollectorResult         // timing & error of collectors in last scrape
+	lastSuccess      map[string]time.Time      // time of last successful run of each collector
+	samples          int64                     // metrics emitted by collectors in current scrape, internal metrics excluded
+	deltaEvery       int                       // delta exposition: full snapshot every n scrapes, 0 disables delta exposition
+	fullSnapshot     bool                      // delta exposition: current scrape emits all series
+	lastValues       map[string]float64        // delta exposition: last emitted value of gauge series
+	roundPow         float64                   // 10^decimals that values are rounded to, 0 disables rounding
+
+	// watchdog state
+	failures     int       // consecutive failed scrapes
+	firstFailure time.Time // time of first failure among consecutive failed scrapes
+	dbRecreated  int64     // times DB handle recreated by watchdog
+
+	// counter reset detection
+	prevTotals    map[string]map[string]float64 // previous total_* stats: datname -> column -> value
+	counterResets map[string]float64            // reset count: datname -> count
+	statsResetAt  time.Time                     // when a reset of any database was last detected, zero if never
+	resets        []string                      // databases with counter reset detected in current scrape
+
+	// backend change detection
+	prevBackends   map[string]string  // previous host:port of show databases: datname -> backend
+	backendChanges map[string]float64 // backend change count: datname -> count
 }
 
-// NewExporter returns a pgbouncer exporter for given DSN
-func NewExporter(dsn string) (e *Exporter) {
-	return &Exporter{dsn: dsn}
+// CollectorResult is timing and error of a collector in one scrape
+type CollectorResult struct {
+	Collector string  `json:"collector"`
+	Duration  float64 `json:"duration_seconds"`
+	Error     string  `json:"error,omitempty"`
 }
 
-// Connect issue a connection to pgbouncer using dsn
-func (e *Exporter) Connect() (err error) {
-	e.DB, err = sql.Open("postgres", e.dsn)
-	if err != nil {
-		return errors.New(fmt.Sprintln("fail to connect to pgbouncer: ", err))
-	}
-	e.DB.SetMaxIdleConns(1)
-	e.DB.SetMaxOpenConns(1)
-	if err = e.DB.Ping(); err != nil {
-		return errors.New(fmt.Sprintln("ping server failed: ", err))
-	}
-	e.pgbouncerUp = true
-	return
+// Collector scrapes metrics of pgbouncer with one (or a group of) show command, e.g. `SHOW POOLS`
+// its name is used in collector group selection, per-collector timeout and timing
+// Describe sends descriptors of its metrics like prometheus.Collector, which are registered along with the exporter
+type Collector interface {
+	Name() string
+	Describe(ch chan<- *prometheus.Desc)
+	Scrape(ctx context.Context, ch chan<- prometheus.Metric) error
 }
 
-// Close disconnect from pgbouncer
-func (e *Exporter) Close() {
-	e.rw.Lock()
-	defer e.rw.Unlock()
-	e.DB.Close()
+// showCollector is builtin Collector backed by scrape method of Exporter, skipped if enabled returns false
+type showCollector struct {
+	name    string
+	scrape  func(context.Context, chan<- prometheus.Metric) error
+	enabled func() bool // nil means always enabled
 }
 
-// RegisterDescriptors will add prometheus descriptor to Exporter map
-func (e *Exporter) RegisterDescriptors() {
-	e.rw.Lock()
-	defer e.rw.Unlock()
-	e.Desc = make(map[string]*prometheus.Desc, 20)
+// Name implements Collector
+func (c *showCollector) Name() string {
+	return c.name
+}
 
-	// Internal metrics
-	e.Desc["pgbouncer_up"] = prometheus.NewDesc("pgbouncer_up", "whether pgbouncer is alive", nil, nil)
-	e.Desc["pgbouncer_scrape_duration"] = prometheus.NewDesc("pgbouncer_scrape_duration", "time that spending on scrapping, in nanoseconds", nil, nil)
-	e.Desc["pgbouncer_scrape_last_time"] = prometheus.NewDesc("pgbouncer_scrape_last_time", "last timestamp of scrape in unix epoch", nil, nil)
-	e.Desc["pgbouncer_scrape_total"] = prometheus.NewDesc("pgbouncer_scrape_total", "total scrape count", nil, nil)
-	e.Desc["pgbouncer_scrape_error_count"] = prometheus.NewDesc("pgbouncer_scrape_error_count", "total error count when scrapping", nil, nil)
+// Describe implements Collector, builtin descriptors are described by Exporter itself
+func (c *showCollector) Describe(ch chan<- *prometheus.Desc) {}
 
-	// List Descriptor
-	e.Desc["pgbouncer_databases"] = prometheus.NewDesc("pgbouncer_databases", "pgbouncer total database count", nil, nil)
-	e.Desc["pgbouncer_users"] = prometheus.NewDesc("pgbouncer_users", "pgbouncer total users count", nil, nil)
-	e.Desc["pgbouncer_pools"] = prometheus.NewDesc("pgbouncer_pools", "pgbouncer total pools count", nil, nil)
-	e.Desc["pgbouncer_free_clients"] = prometheus.NewDesc("pgbouncer_free_clients", "pgbouncer available clients count", nil, nil)
-	e.Desc["pgbouncer_used_clients"] = prometheus.NewDesc("pgbouncer_used_clients", "pgbouncer used clients count", nil, nil)
-	e.Desc["pgbouncer_login_clients"] = prometheus.NewDesc("pgbouncer_login_clients", "pgbouncer login clients count", nil, nil)
-	e.Desc["pgbouncer_free_servers"] = prometheus.NewDesc("pgbouncer_free_servers", "pgbouncer available servers count", nil, nil)
-	e.Desc["pgbouncer_used_servers"] = prometheus.NewDesc("pgbouncer_used_servers", "pgbouncer used servers count", nil, nil)
-	e.Desc["pgbouncer_dns_names"] = prometheus.NewDesc("pgbouncer_dns_names", "pgbouncer dns name count", nil, nil)
-	e.Desc["pgbouncer_dns_zones"] = prometheus.NewDesc("pgbouncer_dns_zones", "pgbouncer dns zone count", nil, nil)
-	e.Desc["pgbouncer_dns_queries"] = prometheus.NewDesc("pgbouncer_dns_queries", "pgbouncer dns queries count", nil, nil)
-	e.Desc["pgbouncer_dns_pending"] = prometheus.NewDesc("pgbouncer_dns_pending", "pgbouncer dns pending queries count", nil, nil)
+// Scrape implements Collector
+func (c *showCollector) Scrape(ctx context.Context, ch chan<- prometheus.Metric) error {
+	return c.scrape(ctx, ch)
+}
 
-	// Mem Descriptor
-	e.Desc["pgbouncer_memory_usage"] = prometheus.NewDesc("pgbouncer_memory_usage", "pgbouncer memory usage", []string{"type"}, nil)
+// builtinCollectors returns collectors of collectorGroups in scrape order
+func (e *Exporter) builtinCollectors() []Collector {
+	peering := func() bool { return !e.disablePeers && !e.noPeering }
+	return []Collector{
+		&showCollector{name: "lists", scrape: e.scrapeShowLists},
+		&showCollector{name: "config", scrape: e.scrapeShowConfig, enabled: func() bool { return !e.disableConfig }}, // before databases & pools, which use default_pool_size
+		&showCollector{name: "mem", scrape: e.scrapeShowMem},
+		&showCollector{name: "stats", scrape: e.scrapeShowStats},
+		&showCollector{name: "databases", scrape: e.scrapeShowDatabases},
+		&showCollector{name: "pools", scrape: e.scrapeShowPools},
+		&showCollector{name: "clock", scrape: e.scrapeClockSkew, enabled: func() bool { return e.enableClock }},
+		&showCollector{name: "servers", scrape: e.scrapeShowServers, enabled: func() bool { return e.enableServers }},
+		&showCollector{name: "peers", scrape: e.scrapeShowPeers, enabled: peering},
+		&showCollector{name: "peer_pools", scrape: e.scrapeShowPeerPools, enabled: peering},
+	}
+}
 
-	// Stats Descriptor
-	e.Desc["pgbouncer_stat_total_xact_count"] = prometheus.NewDesc("pgbouncer_stat_total_xact_count", "pgbouncer total_xact_count of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_total_query_count"] = prometheus.NewDesc("pgbouncer_stat_total_query_count", "pgbouncer total_query_count of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_total_received"] = prometheus.NewDesc("pgbouncer_stat_total_received", "pgbouncer total_received of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_total_sent"] = prometheus.NewDesc("pgbouncer_stat_total_sent", "pgbouncer total_sent of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_total_xact_time"] = prometheus.NewDesc("pgbouncer_stat_total_xact_time", "pgbouncer total_xact_time of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_total_query_time"] = prometheus.NewDesc("pgbouncer_stat_total_query_time", "pgbouncer total_query_time of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_total_wait_time"] = prometheus.NewDesc("pgbouncer_stat_total_wait_time", "pgbouncer total_wait_time of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_xact_count"] = prometheus.NewDesc("pgbouncer_stat_avg_xact_count", "pgbouncer avg_xact_count of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_query_count"] = prometheus.NewDesc("pgbouncer_stat_avg_query_count", "pgbouncer avg_query_count of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_recv"] = prometheus.NewDesc("pgbouncer_stat_avg_recv", "pgbouncer avg_recv of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_sent"] = prometheus.NewDesc("pgbouncer_stat_avg_sent", "pgbouncer avg_sent of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_xact_time"] = prometheus.NewDesc("pgbouncer_stat_avg_xact_time", "pgbouncer avg_xact_time of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_query_time"] = prometheus.NewDesc("pgbouncer_stat_avg_query_time", "pgbouncer avg_query_time of show stats", []string{"datname"}, nil)
-	e.Desc["pgbouncer_stat_avg_wait_time"] = prometheus.NewDesc("pgbouncer_stat_avg_wait_time", "pgbouncer avg_wait_time of show stats", []string{"datname"}, nil)
+// queryErrorKey identifies failed show command by collector name and sqlstate
+type queryErrorKey struct {
+	command  string
+	sqlstate string
+}
 
-	// Database Descriptor
-	e.Desc["pgbouncer_database_pool_size"] = prometheus.NewDesc("pgbouncer_database_pool_size", "pgbouncer database pool_size from show databases", []string{"datname"}, nil)
-	e.Desc["pgbouncer_database_reserve_pool"] = prometheus.NewDesc("pgbouncer_database_reserve_pool", "pgbouncer database reserve_pool from show databases", []string{"datname"}, nil)
-	e.Desc["pgbouncer_database_max_connections"] = prometheus.NewDesc("pgbouncer_database_max_connections", "pgbouncer database max_connections from show databases", []string{"datname"}, nil)
-	e.Desc["pgbouncer_database_current_connections"] = prometheus.NewDesc("pgbouncer_database_current_connections", "pgbouncer database current_connections from show databases", []string{"datname"}, nil)
-	e.Desc["pgbouncer_database_paused"] = prometheus.NewDesc("pgbouncer_database_paused", "pgbouncer database paused from show databases", []string{"datname"}, nil)
-	e.Desc["pgbouncer_database_disabled"] = prometheus.NewDesc("pgbouncer_database_disabled", "pgbouncer database disabled from show databases", []string{"datname"}, nil)
-
-	// Pool Descriptor
-	e.Desc["pgbouncer_pool_cl_active"] = prometheus.NewDesc("pgbouncer_pool_cl_active", "pgbouncer pool cl_active from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_cl_waiting"] = prometheus.NewDesc("pgbouncer_pool_cl_waiting", "pgbouncer pool cl_waiting from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_sv_active"] = prometheus.NewDesc("pgbouncer_pool_sv_active", "pgbouncer pool sv_active from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_sv_idle"] = prometheus.NewDesc("pgbouncer_pool_sv_idle", "pgbouncer pool sv_idle from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_sv_used"] = prometheus.NewDesc("pgbouncer_pool_sv_used", "pgbouncer pool sv_used from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_sv_tested"] = prometheus.NewDesc("pgbouncer_pool_sv_tested", "pgbouncer pool sv_tested from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_sv_login"] = prometheus.NewDesc("pgbouncer_pool_sv_login", "pgbouncer pool sv_login from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_maxwait"] = prometheus.NewDesc("pgbouncer_pool_maxwait", "pgbouncer pool maxwait from show pools", []string{"datname", "user"}, nil)
-	e.Desc["pgbouncer_pool_maxwait_us"] = prometheus.NewDesc("pgbouncer_pool_maxwait_us", "pgbouncer pool maxwait_us from show pools", []string{"datname", "user"}, nil)
+// ExporterOpt configures Exporter
+type ExporterOpt func(*Exporter)
 
+// WithTimeout sets global timeout for each collector
+func WithTimeout(timeout time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.timeout = timeout
+	}
 }
 
-// Collect implment prometheus.Collector
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.Scrape(ch)
+// WithStatementTimeout sets statement_timeout of admin connection on connect, 0 means not set
+func WithStatementTimeout(timeout time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.statementTimeout = timeout
+	}
 }
 
-// Describe implment prometheus.Collector
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	for _, v := range e.Desc {
-		ch <- v
+// WithCollectorTimeout overrides timeout for specific collector, zero means fallback to global timeout
+func WithCollectorTimeout(collector string, timeout time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		if timeout > 0 {
+			e.timeouts[collector] = timeout
+		}
 	}
 }
 
-// Scrape issues query command to pgbouncer and produce metrics
-func (e *Exporter) Scrape(ch chan<- prometheus.Metric) (err error) {
-	e.rw.Lock()
-	defer e.rw.Unlock()
-	startTime := time.Now()
-	if err = e.scrapeShowLists(ch); err != nil {
-		goto final
+// WithRenames sets metric name mapping from original name to new name
+func WithRenames(renames map[string]string) ExporterOpt {
+	return func(e *Exporter) {
+		e.renames = renames
 	}
-	if err = e.scrapeShowMem(ch); err != nil {
-		goto final
+}
+
+// WithHelps overrides help text of metrics by original name
+func WithHelps(helps map[string]string) ExporterOpt {
+	return func(e *Exporter) {
+		e.helps = helps
 	}
-	if err = e.scrapeShowStats(ch); err != nil {
-		goto final
+}
+
+// WithKeyColumn overrides key column of collector, empty column means using default key column
+func WithKeyColumn(collector, column string) ExporterOpt {
+	return func(e *Exporter) {
+		if column != "" {
+			e.keyColumns[collector] = column
+		}
 	}
-	if err = e.scrapeShowDatabases(ch); err != nil {
-		goto final
+}
+
+// WithSampleSize enables round-robin sampling of n databases per scrape, 0 disables sampling
+func WithSampleSize(n int) ExporterOpt {
+	return func(e *Exporter) {
+		e.sampleSize = n
 	}
-	if err = e.scrapeShowPools(ch); err != nil {
-		goto final
+}
+
+// WithConstLabels merges given labels into constant labels of every metric
+func WithConstLabels(labels prometheus.Labels) ExporterOpt {
+	return func(e *Exporter) {
+		if e.constLabels == nil {
+			e.constLabels = make(prometheus.Labels, len(labels))
+		}
+		for k, v := range labels {
+			e.constLabels[k] = v
+		}
 	}
+}
 
-final:
-	e.lastScrape = time.Now()
-	e.scrapeDuration = e.lastScrape.Sub(startTime)
-	e.totalScrapes++
+// WithTLSConfig sets custom tls config used when connecting to pgbouncer, nil means using sslmode of dsn
+func WithTLSConfig(config *tls.Config) ExporterOpt {
+	return func(e *Exporter) {
+		e.tlsConfig = config
+	}
+}
 
-	if err != nil {
-		e.pgbouncerUp = false
-		e.errorCount++
-		log.Printf("scrape failed: %s", err.Error())
-	} else {
-		e.pgbouncerUp = true
+// WithUserFilter sets glob patterns of users whose pools are scraped
+// empty include means all users, exclude takes precedence over include
+func WithUserFilter(include, exclude []string) ExporterOpt {
+	return func(e *Exporter) {
+		e.includeUsers, e.excludeUsers = include, exclude
 	}
+}
 
-	// send internal metrics
-	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_up"], prometheus.GaugeValue, cast2Float64(e.pgbouncerUp))
-	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_duration"], prometheus.GaugeValue, cast2Float64(e.scrapeDuration))
-	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_last_time"], prometheus.GaugeValue, cast2Float64(e.lastScrape))
-	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_total"], prometheus.CounterValue, cast2Float64(e.totalScrapes))
-	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_error_count"], prometheus.CounterValue, cast2Float64(e.errorCount))
+// WithInfoColumns exposes given string columns of collectors (databases, pools) as info metrics, e.g. pools: pool_mode
+func WithInfoColumns(columns map[string][]string) ExporterOpt {
+	return func(e *Exporter) {
+		e.infoColumns = columns
+	}
+}
 
-	return err
+// WithDatnameNormalized replaces datname matching regex with replacement (which could refer to groups like $1)
+// in stats, databases and pools, and aggregates metrics of same normalized name by summing. nil regex disables it
+func WithDatnameNormalized(regex *regexp.Regexp, replacement string) ExporterOpt {
+	return func(e *Exporter) {
+		e.datnameRegex, e.datnameReplace = regex, replacement
+	}
 }
 
-// scrapeShowLists fetch metrics from `SHOW LISTS`
-func (e *Exporter) scrapeShowLists(ch chan<- prometheus.Metric) (err error) {
-	rows, err := e.DB.Query(`SHOW LISTS;`)
-	if err != nil {
-		return errors.New(fmt.Sprintln("Error retrieving rows: ", err))
+// WithPoolUserLabelDropped drops user label of pool metrics, and aggregates pools of same database
+func WithPoolUserLabelDropped(drop bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.noUserLabel = drop
 	}
-	defer rows.Close()
+}
 
-	nColumn := 2
-	columnData := make([]interface{}, nColumn)
-	scanArgs := make([]interface{}, nColumn)
-	for i := 0; i < nColumn; i++ {
-		scanArgs[i] = &columnData[i]
+// WithMemoryLimit enables pgbouncer_memory_limit_ratio against given limit in bytes, 0 disables it
+func WithMemoryLimit(limit int64) ExporterOpt {
+	return func(e *Exporter) {
+		e.memoryLimit = limit
 	}
+}
 
-	listResult := make(map[string]float64)
-	for rows.Next() {
-		if err = rows.Scan(scanArgs...); err != nil {
-			fmt.Println(err.Error())
-			return errors.New(fmt.Sprintln("Error scanning rows: ", err))
-		}
+// WithZeroPoolsSuppressed skips metrics of pools whose counters are all zero, trading continuity for cardinality
+func WithZeroPoolsSuppressed(suppress bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.suppressZeroPools = suppress
+	}
+}
 
-		listResult[cast2string(columnData[0])] = cast2Float64(columnData[1])
+// WithCollector appends a custom collector, which runs after builtin ones in each scrape, its name should be unique
+func WithCollector(c Collector) ExporterOpt {
+	return func(e *Exporter) {
+		e.collectorList = append(e.collectorList, c)
 	}
+}
 
-	for k, v := range listResult {
-		ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_%s", k)], prometheus.GaugeValue, v)
+// WithCollectors restricts scrape to given collector groups, e.g. one shard of metrics, empty means all
+func WithCollectors(groups []string) ExporterOpt {
+	return func(e *Exporter) {
+		if len(groups) == 0 {
+			e.collectors = nil
+			return
+		}
+		e.collectors = make(map[string]bool, len(groups))
+		for _, group := range groups {
+			e.collectors[group] = true
+		}
 	}
+}
 
-	return nil
+// WithConfigDisabled disables `SHOW CONFIG` collector and metrics derived from it
+func WithConfigDisabled(disableConfig bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.disableConfig = disableConfig
+	}
 }
 
-// scrapeShowMem fetch metrics from `SHOW MEM`
-func (e *Exporter) scrapeShowMem(ch chan<- prometheus.Metric) (err error) {
-	rows, err := e.DB.Query(`SHOW MEM;`)
-	if err != nil {
-		return errors.New(fmt.Sprintln("Error retrieving rows: ", err))
+// WithClockSkew enables clock skew measurement with `SHOW CLIENTS`
+func WithClockSkew(enableClock bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.enableClock = enableClock
 	}
-	defer rows.Close()
+}
 
-	nColumn := 5
-	columnData := make([]interface{}, nColumn)
-	scanArgs := make([]interface{}, nColumn)
-	for i := 0; i < nColumn; i++ {
-		scanArgs[i] = &columnData[i]
+// WithPgbouncerLocation sets time zone of pgbouncer, which formats timestamps with zone abbreviations, exporter local time zone by default
+func WithPgbouncerLocation(loc *time.Location) ExporterOpt {
+	return func(e *Exporter) {
+		e.location = loc
 	}
+}
 
-	memResult := make(map[string]float64)
-	for rows.Next() {
-		if err = rows.Scan(scanArgs...); err != nil {
-			fmt.Println(err.Error())
-			return errors.New(fmt.Sprintln("Error scanning rows: ", err))
-		}
-		memResult[cast2string(columnData[0])] = cast2Float64(columnData[4])
+// WithServers enables `SHOW SERVERS` collector, which aggregates server connections by pool
+func WithServers(enableServers bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.enableServers = enableServers
 	}
+}
 
-	for k, v := range memResult {
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_memory_usage"], prometheus.GaugeValue, v, k)
+// WithPeersDisabled disables `SHOW PEERS` and `SHOW PEER_POOLS` collectors
+func WithPeersDisabled(disablePeers bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.disablePeers = disablePeers
 	}
-	return nil
 }
 
-// scrapeShowStats fetch metrics from `SHOW STATS`
-func (e *Exporter) scrapeShowStats(ch chan<- prometheus.Metric) (err error) {
-	rows, err := e.DB.Query(`SHOW STATS;`)
-	if err != nil {
-		return errors.New(fmt.Sprintln("Error retrieving rows: ", err))
+// WithUnusedDatabases enables pgbouncer_database_unused, which cross-references show databases & show stats
+func WithUnusedDatabases(emitUnused bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.emitUnused = emitUnused
 	}
-	defer rows.Close()
+}
 
-	nColumn := 15
-	columnData := make([]interface{}, nColumn)
-	scanArgs := make([]interface{}, nColumn)
-	for i := 0; i < nColumn; i++ {
-		scanArgs[i] = &columnData[i]
+// WithDeltas enables pgbouncer_stat_*_delta gauges of total_* stats
+func WithDeltas(emitDeltas bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.emitDeltas = emitDeltas
 	}
+}
 
-	statResult := make(map[string]map[string]float64, 5)
-	for rows.Next() {
-		if err = rows.Scan(scanArgs...); err != nil {
-			fmt.Println(err.Error())
-			return errors.New(fmt.Sprintln("Error scanning rows: ", err))
-		}
-
-		statRow := make(map[string]float64, 14)
-		datname := cast2string(columnData[0])
-		statRow["total_xact_count"] = cast2Float64(columnData[1])
-		statRow["total_query_count"] = cast2Float64(columnData[2])
-		statRow["total_received"] = cast2Float64(columnData[3])
-		statRow["total_sent"] = cast2Float64(columnData[4])
-		statRow["total_xact_time"] = cast2Float64(columnData[5])
-		statRow["total_query_time"] = cast2Float64(columnData[6])
-		statRow["total_wait_time"] = cast2Float64(columnData[7])
-		statRow["avg_xact_count"] = cast2Float64(columnData[8])
-		statRow["avg_query_count"] = cast2Float64(columnData[9])
-		statRow["avg_recv"] = cast2Float64(columnData[10])
-		statRow["avg_sent"] = cast2Float64(columnData[11])
-		statRow["avg_xact_time"] = cast2Float64(columnData[12])
-		statRow["avg_query_time"] = cast2Float64(columnData[13])
-		statRow["avg_wait_time"] = cast2Float64(columnData[14])
-		statResult[datname] = statRow
+// WithCounterResetFailure fails the scrape (pgbouncer_up = 0) when total_* stats decreased, for strict setups alerting on unexpected resets
+func WithCounterResetFailure(fail bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.failOnReset = fail
 	}
+}
 
-	for datname, datStat := range statResult {
-		for k, v := range datStat {
-			if strings.HasPrefix(k, "total") {
-				ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_stat_%s", k)], prometheus.CounterValue, v, datname)
-			} else {
-				ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_stat_%s", k)], prometheus.GaugeValue, v, datname)
-			}
-		}
+// WithHashedLabels replaces datname & user label values with salted hashes, empty salt disables hashing
+func WithHashedLabels(salt string) ExporterOpt {
+	return func(e *Exporter) {
+		e.hashSalt = salt
 	}
+}
 
-	return nil
+// WithDeltaExposition suppresses gauges unchanged since last scrape, with a full snapshot every n scrapes, 0 disables it
+// EXPERIMENTAL: prometheus expects full snapshots, suppressed series become stale after 5m in a standard pull setup
+func WithDeltaExposition(fullEvery int) ExporterOpt {
+	return func(e *Exporter) {
+		e.deltaEvery = fullEvery
+	}
 }
 
-// scrapeShowDatabases fetch metrics from `SHOW DATABASES`
-func (e *Exporter) scrapeShowDatabases(ch chan<- prometheus.Metric) (err error) {
-	rows, err := e.DB.Query(`SHOW DATABASES;`)
-	if err != nil {
-		return errors.New(fmt.Sprintln("Error retrieving rows: ", err))
+// WithRounding rounds values of gauges & counters from pgbouncer to given decimal places, negative disables rounding
+func WithRounding(decimals int) ExporterOpt {
+	return func(e *Exporter) {
+		if decimals >= 0 {
+			e.roundPow = math.Pow10(decimals)
+		}
 	}
-	defer rows.Close()
+}
 
-	nColumn := 12
-	columnData := make([]interface{}, nColumn)
-	scanArgs := make([]interface{}, nColumn)
-	for i := 0; i < nColumn; i++ {
-		scanArgs[i] = &columnData[i]
+// WithHeartbeat enables pgbouncer_exporter_heartbeat_total, which increases on every scrape even if pgbouncer is down
+func WithHeartbeat(heartbeat bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.heartbeat = heartbeat
 	}
+}
 
-	for rows.Next() {
-		if err = rows.Scan(scanArgs...); err != nil {
-			fmt.Println(err.Error())
-			return errors.New(fmt.Sprintln("Error scanning rows: ", err))
-		}
+// WithUpOnly makes scrape a ping only, which exposes pgbouncer_up and scrape metrics, for availability monitoring of many nodes
+func WithUpOnly(upOnly bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.upOnly = upOnly
+	}
+}
 
-		datname := cast2string(columnData[0])
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_pool_size"], prometheus.GaugeValue, cast2Float64(columnData[5]), datname)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_reserve_pool"], prometheus.GaugeValue, cast2Float64(columnData[6]), datname)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_max_connections"], prometheus.GaugeValue, cast2Float64(columnData[8]), datname)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_current_connections"], prometheus.GaugeValue, cast2Float64(columnData[9]), datname)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_paused"], prometheus.GaugeValue, cast2Float64(columnData[10]), datname)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_disabled"], prometheus.GaugeValue, cast2Float64(columnData[11]), datname)
+// WithNativeHistograms makes histograms native (exponential) ones without classic buckets
+func WithNativeHistograms(native bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.nativeHisto = native
+	}
+}
 
+// WithApplicationName sets application_name of connection, unless dsn has one already
+func WithApplicationName(name string) ExporterOpt {
+	return func(e *Exporter) {
+		e.appName = name
 	}
-	return nil
 }
 
-// scrapeShowPools fetch metrics from `SHOW POOLS`
-func (e *Exporter) scrapeShowPools(ch chan<- prometheus.Metric) (err error) {
-	rows, err := e.DB.Query(`SHOW POOLS;`)
-	if err != nil {
-		return errors.New(fmt.Sprintln("Error retrieving rows: ", err))
+// WithMaxConns sets max open & idle connections of DB handle, 1 by default which makes queries strictly serial
+func WithMaxConns(maxOpen, maxIdle int) ExporterOpt {
+	return func(e *Exporter) {
+		e.maxOpen = maxOpen
+		e.maxIdle = maxIdle
 	}
-	defer rows.Close()
+}
 
-	nColumn := 12
-	columnData := make([]interface{}, nColumn)
-	scanArgs := make([]interface{}, nColumn)
-	for i := 0; i < nColumn; i++ {
-		scanArgs[i] = &columnData[i]
+// NewExporter returns a pgbouncer exporter for given DSN
+func NewExporter(dsn string, opts ...ExporterOpt) (e *Exporter) {
+	e = &Exporter{
+		dsn:            dsn,
+		maxOpen:        1,
+		maxIdle:        1,
+		timeouts:       make(map[string]time.Duration),
+		keyColumns:     make(map[string]string, len(defaultKeyColumns)),
+		prevTotals:     make(map[string]map[string]float64),
+		counterResets:  make(map[string]float64),
+		prevBackends:   make(map[string]string),
+		backendChanges: make(map[string]float64),
+		queryErrors:    make(map[queryErrorKey]float64),
+		lastSuccess:    make(map[string]time.Time),
+		reloadedAt:     time.Now(),
+		opts:           opts,
+	}
+	for collector, column := range defaultKeyColumns {
+		e.keyColumns[collector] = column
 	}
+	e.collectorList = e.builtinCollectors()
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
 
-	for rows.Next() {
-		if err = rows.Scan(scanArgs...); err != nil {
-			fmt.Println(err.Error())
-			return errors.New(fmt.Sprintln("Error scanning rows: ", err))
+// Connect issue a connection to pgbouncer using dsn, DB handle is reused if already opened
+func (e *Exporter) Connect() (err error) {
+	return e.connect(context.Background())
+}
+
+// connect errors, distinguished with errors.Is: invalid dsn or driver config, or pgbouncer not reachable
+var (
+	ErrDriverInit = errors.New("failed to initialize driver")
+	ErrPing       = errors.New("failed to reach pgbouncer (ping)")
+)
+
+// connect issue a connection to pgbouncer with context, ping failure is counted as query error of command connect
+// connecting is bounded by global timeout, as it runs with the scrape mutex held
+func (e *Exporter) connect(ctx context.Context) (err error) {
+	if e.DB == nil {
+		if e.DB, err = e.openDB(); err != nil {
+			return err
 		}
+	}
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	if err = e.ping(ctx); err != nil {
+		return err
+	}
+	e.pgbouncerUp = true // only after pgbouncer is reached
+	e.connectedAt = time.Now()
+	e.noPeering = false // pgbouncer may be upgraded
+	e.supported = nil
+	e.setStatementTimeout(ctx)
+	if !e.upOnly {
+		e.checkPrivileges(ctx)
+	}
+	return
+}
+
+// openDB opens DB handle of dsn with connection limits, which connects lazily, so no network I/O is done here
+func (e *Exporter) openDB() (db *sql.DB, err error) {
+	dsn, err := e.connDSN()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDriverInit, err)
+	}
+	if e.tlsConfig != nil {
+		db, err = openTLS(dsn, e.tlsConfig)
+	} else {
+		db, err = sql.Open("postgres", dsn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDriverInit, err)
+	}
+	db.SetMaxIdleConns(e.maxIdle)
+	db.SetMaxOpenConns(e.maxOpen)
+	return db, nil
+}
 
-		datname := cast2string(columnData[0])
-		username := cast2string(columnData[1])
+// connDSN returns dsn that connections are opened with, which has application_name appended unless dsn has one
+func (e *Exporter) connDSN() (string, error) {
+	if opts, _ := parseDSN(e.dsn); e.appName == "" || opts["application_name"] != "" {
+		return e.dsn, nil
+	}
+	return dsnWithOption(e.dsn, "application_name", e.appName)
+}
 
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_cl_active"], prometheus.GaugeValue, cast2Float64(columnData[2]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_cl_waiting"], prometheus.GaugeValue, cast2Float64(columnData[3]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_sv_active"], prometheus.GaugeValue, cast2Float64(columnData[4]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_sv_idle"], prometheus.GaugeValue, cast2Float64(columnData[5]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_sv_used"], prometheus.GaugeValue, cast2Float64(columnData[6]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_sv_tested"], prometheus.GaugeValue, cast2Float64(columnData[7]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_sv_login"], prometheus.GaugeValue, cast2Float64(columnData[8]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_maxwait"], prometheus.GaugeValue, cast2Float64(columnData[9]), datname, username)
-		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_maxwait_us"], prometheus.GaugeValue, cast2Float64(columnData[10]), datname, username)
+// ping checks pgbouncer is reachable within global timeout, failure is counted as query error of command connect
+func (e *Exporter) ping(ctx context.Context) error {
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	db := e.DB
+	if err := e.async(ctx, func() error { return db.PingContext(ctx) }); err != nil {
+		e.pgbouncerUp = false
+		e.countQueryError("connect", err)
+		return fmt.Errorf("%w: %w", ErrPing, err)
 	}
 	return nil
 }
 
-// cast2Float64 cast database driver interface{} to float64
-func cast2Float64(t interface{}) float64 {
-	switch v := t.(type) {
-	case int64:
-		return float64(v)
-	case float64:
-		return v
-	case time.Time:
-		return float64(v.Unix())
-	case time.Duration:
-		return float64(v.Nanoseconds())
-	case []byte:
-		strV := string(v)
-		result, err := strconv.ParseFloat(strV, 64)
-		if err != nil {
-			return math.NaN()
-		}
-		return result
-	case string:
-		result, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			return math.NaN()
-		}
-		return result
-	case bool:
-		if v {
-			return 1.0
-		}
-		return 0.0
-	case nil:
-		return math.NaN()
-	default:
-		return math.NaN()
+// setStatementTimeout issues `SET statement_timeout` on connect if configured, as a safeguard besides context timeouts
+// pgbouncer admin console may reject it as it is not a pgbouncer setting, which is logged and ignored
+func (e *Exporter) setStatementTimeout(ctx context.Context) {
+	if e.statementTimeout <= 0 {
+		return
+	}
+	db, query := e.DB, fmt.Sprintf(`SET statement_timeout = %d;`, e.statementTimeout.Milliseconds())
+	if err := e.async(ctx, func() error { _, err := db.ExecContext(ctx, query); return err }); err != nil {
+		log.Printf("statement_timeout %v is not honored by pgbouncer admin console, only context timeouts apply: %s", e.statementTimeout, err.Error())
+	}
+}
+
+// checkPrivileges runs `SHOW STATS` once after connect, to learn whether user is in stats_users (or admin_users)
+// errors other than authorization error are left to collectors, connect succeeds anyway
+func (e *Exporter) checkPrivileges(ctx context.Context) {
+	db := e.DB
+	err := e.async(ctx, func() error {
+		rows, err := db.QueryContext(ctx, `SHOW STATS;`)
+		if err == nil {
+			rows.Close()
+		}
+		return err
+	})
+	if err == nil {
+		e.privileged, e.privilegeChecked = true, true
+		return
+	}
+	if isAuthError(err) {
+		e.privileged, e.privilegeChecked = false, true
+		log.Printf("connected but lacking stats privileges: %s", e.authHint("stats"))
+	}
+}
+
+// reconnect re-invoke Connect after previous connect or scrape failure
+func (e *Exporter) reconnect(ctx context.Context) error {
+	e.reconnects++
+	return e.connect(ctx)
+}
+
+// withTimeout bounds ctx with global timeout if set, for queries other than collectors (e.g. connect, probe)
+func (e *Exporter) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.timeout > 0 {
+		return context.WithTimeout(ctx, e.timeout)
+	}
+	return ctx, func() {}
+}
+
+// async runs f in a goroutine and returns its error, or ctx error as soon as ctx is done while f keeps running in background,
+// as driver calls may outlive ctx, e.g. lib/pq keeps waiting for startup response of a hung server. f must not touch exporter state
+func (e *Exporter) async(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	atomic.AddInt64(&e.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&e.goroutines, -1)
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watchdogInterval is how often watchdog checks scrape failures
+const watchdogInterval = 10 * time.Second
+
+// Watchdog recreates DB handle via sql.Open if at least `failures` consecutive scrapes failed over `window`,
+// in case the *sql.DB itself is in a bad state. It runs until ctx is done, failures <= 0 disables it
+func (e *Exporter) Watchdog(ctx context.Context, failures int, window time.Duration) {
+	if failures <= 0 {
+		return
+	}
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.watchdogCheck(failures, window)
+		}
+	}
+}
+
+// watchdogCheck recreates DB handle if scrapes keep failing, the new handle connects on next scrape
+// network I/O is never done with the scrape mutex held: opening a handle does not connect, and the old one is closed after unlock
+func (e *Exporter) watchdogCheck(failures int, window time.Duration) (recreated bool) {
+	e.rw.Lock()
+	if e.failures < failures || time.Since(e.firstFailure) < window {
+		e.rw.Unlock()
+		return false
+	}
+	log.Printf("watchdog: %d consecutive scrapes failed since %s, recreating DB handle", e.failures, e.firstFailure.Format(time.RFC3339))
+	db, err := e.openDB()
+	if err != nil {
+		e.rw.Unlock()
+		log.Printf("watchdog: fail to recreate DB handle: %s", redactDSN(err.Error()))
+		return false
+	}
+	old := e.DB
+	e.DB = db
+	e.dbRecreated++
+	e.failures = 0
+	e.pgbouncerUp = false // reconnect with the new handle on next scrape
+	e.rw.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return true
+}
+
+// Reload applies opts to running exporter and rebuilds descriptors, e.g. help overrides re-read on SIGHUP
+// NOTICE: pgbouncer_pool_wait_seconds histogram is recreated, so it starts from zero like a counter reset
+func (e *Exporter) Reload(opts ...ExporterOpt) error {
+	e.rw.Lock()
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.opts = append(e.opts[:len(e.opts):len(e.opts)], opts...)
+	e.rw.Unlock()
+	err := e.RegisterDescriptors()
+	e.recordReload(err)
+	return err
+}
+
+// recordReload records outcome of a reload, which is exposed as pgbouncer_config_reload_success
+func (e *Exporter) recordReload(err error) {
+	e.rw.Lock()
+	defer e.rw.Unlock()
+	e.reloadFailed = err != nil
+	if err == nil {
+		e.reloadedAt = time.Now()
+	}
+}
+
+// ReloadConfig re-reads reloadable config files (-help-file) and applies them to exporters, which is done on SIGHUP
+// if any file is invalid, exporters keep previous config and the failure is recorded on each of them
+// descriptors are not rebuilt if nothing is reloadable, so state such as wait histogram survives SIGHUP
+func ReloadConfig(helpFile string, exporters []*Exporter) error {
+	var opts []ExporterOpt
+	if helpFile != "" {
+		helps, err := LoadHelps(helpFile)
+		if err != nil {
+			for _, e := range exporters {
+				e.recordReload(err)
+			}
+			return fmt.Errorf("invalid -help-file: %w", err)
+		}
+		opts = append(opts, WithHelps(helps))
+	}
+	if len(opts) == 0 {
+		for _, e := range exporters {
+			e.recordReload(nil)
+		}
+		return nil
+	}
+	for _, e := range exporters {
+		if err := e.Reload(opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close disconnect from pgbouncer
+func (e *Exporter) Close() {
+	e.rw.Lock()
+	defer e.rw.Unlock()
+	if e.DB != nil {
+		e.DB.Close()
+	}
+}
+
+// newDesc registers descriptor with fully-qualified name `namespace_subsystem_name` to Exporter map
+// constant labels are attached here, conflicts with variable labels are reported when registering exporter
+// descriptor is keyed by original name, while the emitted name could be remapped by renames
+func (e *Exporter) newDesc(subsystem, name, help string, variableLabels ...string) {
+	fqName := prometheus.BuildFQName(namespace, subsystem, name)
+	metricName := fqName
+	if newName, exists := e.renames[fqName]; exists {
+		metricName = newName
+	}
+	if newHelp, exists := e.helps[fqName]; exists {
+		help = newHelp
+	}
+	e.Desc[fqName] = prometheus.NewDesc(metricName, help, variableLabels, e.constLabels)
+}
+
+// newHistogram creates histogram and registers its descriptor like newDesc, it is native if nativeHisto is set
+func (e *Exporter) newHistogram(subsystem, name, help string, buckets []float64) prometheus.Histogram {
+	fqName := prometheus.BuildFQName(namespace, subsystem, name)
+	opts := prometheus.HistogramOpts{Name: fqName, Help: help, ConstLabels: e.constLabels, Buckets: buckets}
+	if newName, exists := e.renames[fqName]; exists {
+		opts.Name = newName
+	}
+	if newHelp, exists := e.helps[fqName]; exists {
+		opts.Help = newHelp
+	}
+	if e.nativeHisto {
+		opts.Buckets = nil
+		opts.NativeHistogramBucketFactor = 1.1
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	histogram := prometheus.NewHistogram(opts)
+	e.Desc[fqName] = histogram.Desc()
+	return histogram
+}
+
+// checkRenames validates renames refer to known metrics, and emitted names never collide
+func (e *Exporter) checkRenames() error {
+	emitted := make(map[string]string, len(e.Desc))
+	for name := range e.Desc {
+		metricName := name
+		if _, exists := e.renames[name]; exists {
+			metricName = e.renames[name]
+		}
+		if other, exists := emitted[metricName]; exists {
+			return fmt.Errorf("metric %s and %s are both emitted as %s", other, name, metricName)
+		}
+		emitted[metricName] = name
+	}
+	for oldName := range e.renames {
+		if _, exists := e.Desc[oldName]; !exists {
+			return fmt.Errorf("unknown metric %s to rename", oldName)
+		}
+	}
+	for name := range e.helps {
+		if _, exists := e.Desc[name]; !exists {
+			log.Printf("help override of unknown metric %s is ignored, use original metric name", name)
+		}
+	}
+	return nil
+}
+
+// LoadHelps reads help overrides from json file, which is an object mapping original metric name to help text
+func LoadHelps(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	helps := make(map[string]string)
+	if err := json.Unmarshal(data, &helps); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	for name, help := range helps {
+		if help == "" {
+			return nil, fmt.Errorf("empty help of metric %s in %s", name, filename)
+		}
+	}
+	return helps, nil
+}
+
+// RegisterDescriptors will add prometheus descriptor to Exporter map
+func (e *Exporter) RegisterDescriptors() error {
+	e.rw.Lock()
+	defer e.rw.Unlock()
+	e.Desc = make(map[string]*prometheus.Desc, 20)
+
+	// Internal metrics
+	e.newDesc("", "up", "whether pgbouncer is alive")
+	e.newDesc(subsystemScrape, "duration", "time that spending on scrapping, in nanoseconds")
+	e.newDesc(subsystemScrape, "last_time", "last timestamp of scrape in unix epoch")
+	e.newDesc(subsystemScrape, "total", "total scrape count")
+	e.newDesc(subsystemScrape, "error_count", "total error count when scrapping")
+	e.newDesc("", "connection_info", "connection info of exporter, transport is unix or tcp", "transport", "host")
+	e.newDesc("", "query_errors_total", "failed show commands by command (collector name, or connect for ping) and sqlstate, none if not a server error", "command", "sqlstate")
+	e.newDesc("", "db_handle_recreated_total", "times that watchdog recreated DB handle after continuous scrape failures")
+	e.newDesc("", "connection_age_seconds", "seconds since exporter (re)connected to pgbouncer")
+	e.newDesc("", "supported_commands", "1 if optional show command is supported by target, probed once per connection", "command")
+	e.newDesc("collector", "age_seconds", "seconds since last successful run of collector, which grows if collector keeps failing or is skipped", "collector")
+	e.newDesc("exporter", "collector_enabled", "1 if collector is enabled, 0 if disabled by flags or skipped automatically, e.g. peers before pgbouncer 1.21", "collector")
+	e.newDesc("exporter", "heartbeat_total", "scrapes started by exporter regardless of pgbouncer health, flat means exporter itself stopped scraping")
+	e.newDesc("", "reconnects_total", "times that exporter reconnect to pgbouncer after failure")
+	e.newDesc("", "tls_insecure", "1 if pgbouncer certificate verification is skipped by -tls-insecure-skip-verify, which must not be used in production")
+	e.newDesc("config", "reload_success", "1 if last reload of config files on SIGHUP succeeded (or none yet), 0 if it failed and previous config is kept")
+	e.newDesc("config", "last_reload_timestamp", "unix timestamp of startup or last successful reload of config files on SIGHUP")
+	e.newDesc("", "admin_privileges", "1 if user could run show stats when connected, 0 if not authorized (not in stats_users or admin_users)")
+	e.newDesc("", "sample_offset", "index of first database sampled by next scrape among sorted databases, only when sampling enabled")
+	e.newDesc(subsystemScrape, "timeout_seconds", "configured timeout of each collector in seconds, 0 means no timeout")
+	e.newDesc(subsystemScrape, "goroutines_active", "scrape goroutines still running, including timeout ones that are still draining")
+	e.newDesc(subsystemScrape, "queue_wait_seconds", "time that this scrape waited for in-progress scrape to finish, non-zero means scrapes are contending rather than pgbouncer being slow")
+	e.newDesc(subsystemScrape, "samples", "metrics emitted by collectors in last scrape, internal metrics excluded")
+
+	// List Descriptor
+	e.newDesc("", "databases", "pgbouncer total database count")
+	e.newDesc("", "users", "pgbouncer total users count")
+	e.newDesc("", "pools", "pgbouncer total pools count")
+	e.newDesc("", "free_clients", "pgbouncer available clients count")
+	e.newDesc("", "used_clients", "pgbouncer used clients count")
+	e.newDesc("", "login_clients", "pgbouncer login clients count")
+	e.newDesc("", "free_servers", "pgbouncer available servers count")
+	e.newDesc("", "used_servers", "pgbouncer used servers count")
+	e.newDesc("", "dns_names", "pgbouncer dns name count")
+	e.newDesc("", "dns_zones", "pgbouncer dns zone count")
+	e.newDesc("", "dns_queries", "pgbouncer dns queries count")
+	e.newDesc("", "dns_pending", "pgbouncer dns pending queries count")
+	e.newDesc("", "clients_active_ratio", "used_clients / (used_clients + free_clients + login_clients) from show lists")
+
+	// Derived Descriptor
+	e.newDesc("", "clock_skew_seconds", "pgbouncer clock minus exporter clock, from request_time of admin clients in show clients, in 1s precision")
+	e.newDesc("", "logins_in_progress", "connections in authentication: sum of sv_login from show pools plus login_clients from show lists")
+	e.newDesc("", "topology_mismatch", "1 if databases & pools of show lists differ from rows of show databases & show pools, e.g. admin console proxied by chained pgbouncer")
+	e.newDesc("", "avg_connections_per_pool", "server connections (sv_active+sv_idle+sv_used+sv_tested+sv_login of all pools) divided by pools of show lists")
+	e.newDesc("", "client_connections_saturation", "(used_clients + login_clients) / max_client_conn, from show lists & show config")
+	e.newDesc("", "process_info", "always 1, pid of pgbouncer read from pidfile of show config, absent if pidfile is not set or not readable by exporter", "pid")
+	e.newDesc(subsystemPool, "mode", "1 for the global pool_mode of show config (session, transaction or statement), 0 for others", "mode")
+	e.newDesc("", "client_limit_reached", "1 if used_clients + login_clients >= max_client_conn, when new clients are rejected by pgbouncer")
+
+	// Mem Descriptor
+	e.newDesc(subsystemMemory, "usage", "pgbouncer memory usage", "type")
+	e.newDesc("prepared_statements", "cache_bytes", "memtotal of prepared statement cache memory pool from show mem", "type")
+	e.newDesc("prepared_statements", "cache_used", "used items of prepared statement cache memory pool from show mem", "type")
+	e.newDesc("prepared_statements", "max", "max_prepared_statements from show config, 0 means prepared statement support is disabled")
+	e.newDesc(subsystemMemory, "total_bytes", "sum of memtotal of all memory pools from show mem")
+	e.newDesc(subsystemMemory, "limit_ratio", "memory total_bytes / configured -memory-limit")
+
+	// Stats Descriptor
+	e.newDesc("network", "recv_bytes_per_second", "bytes per second received from clients, sum of avg_recv of all databases in show stats averaged by pgbouncer over stats_period")
+	e.newDesc("network", "sent_bytes_per_second", "bytes per second sent to clients, sum of avg_sent of all databases in show stats averaged by pgbouncer over stats_period")
+	e.newDesc(subsystemStat, "total_xact_count", "pgbouncer total_xact_count of show stats", "datname")
+	e.newDesc(subsystemStat, "total_query_count", "pgbouncer total_query_count of show stats", "datname")
+	e.newDesc(subsystemStat, "total_received", "pgbouncer total_received of show stats", "datname")
+	e.newDesc(subsystemStat, "total_sent", "pgbouncer total_sent of show stats", "datname")
+	e.newDesc(subsystemStat, "total_xact_time", "pgbouncer total_xact_time of show stats", "datname")
+	e.newDesc(subsystemStat, "total_query_time", "pgbouncer total_query_time of show stats", "datname")
+	e.newDesc(subsystemStat, "total_wait_time", "pgbouncer total_wait_time of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_xact_count", "pgbouncer avg_xact_count of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_query_count", "pgbouncer avg_query_count of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_recv", "pgbouncer avg_recv of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_sent", "pgbouncer avg_sent of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_xact_time", "pgbouncer avg_xact_time of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_query_time", "pgbouncer avg_query_time of show stats", "datname")
+	e.newDesc(subsystemStat, "avg_wait_time", "pgbouncer avg_wait_time of show stats", "datname")
+	e.newDesc(subsystemStat, "queries_per_xact", "total_query_count / total_xact_count of show stats, high value may indicate chatty clients", "datname")
+	for _, column := range statColumns {
+		if strings.HasPrefix(column, "total_") {
+			e.newDesc(subsystemStat, deltaName(column), fmt.Sprintf("change of %s of show stats since previous scrape, 0 on first scrape", column), "datname")
+		}
+	}
+	e.newDesc("", "counter_reset_total", "times that any total_* of show stats decreased compared to previous scrape, usually pgbouncer restart", "datname")
+	e.newDesc("", "stats_since_reset_seconds", "seconds since exporter last detected a reset of show stats totals of any database, absent until a reset is detected")
+
+	// Database Descriptor
+	e.newDesc(subsystemDatabase, "pool_size", "pgbouncer database pool_size from show databases", "datname")
+	e.newDesc(subsystemDatabase, "reserve_pool", "pgbouncer database reserve_pool from show databases", "datname")
+	e.newDesc(subsystemDatabase, "max_connections", "pgbouncer database max_connections from show databases", "datname")
+	e.newDesc(subsystemDatabase, "current_connections", "pgbouncer database current_connections from show databases", "datname")
+	e.newDesc(subsystemDatabase, "paused", "pgbouncer database paused from show databases", "datname")
+	e.newDesc(subsystemDatabase, "disabled", "pgbouncer database disabled from show databases", "datname")
+	e.newDesc(subsystemDatabase, "unused", "1 if database of show databases has no transaction or query in show stats since pgbouncer started", "datname")
+	e.newDesc(subsystemDatabase, "over_pool_size", "1 if current_connections of database exceeds pool_size (default_pool_size if 0), i.e. using reserve pool", "datname")
+	e.newDesc(subsystemDatabase, "backend_changed_total", "times that host or port of database changed compared to previous scrape, e.g. repointed by RELOAD", "datname")
+	e.newDesc("", "databases_paused", "number of paused databases from show databases")
+	e.newDesc("", "maintenance_mode", "1 if all databases except pgbouncer are paused (e.g. by PAUSE), 0 if any is not paused or there is no database")
+	e.newDesc("", "databases_disabled", "number of disabled databases from show databases")
+	e.newDesc("", "unique_databases", "number of distinct datname (after -datname-regex) in show databases, except admin console pgbouncer")
+
+	// Pool Descriptor, user label is dropped if pools are aggregated by database
+	poolLabels := []string{"datname", "user"}
+	if e.noUserLabel {
+		poolLabels = poolLabels[:1]
+	}
+
+	// Info Descriptor of string columns, with column value as an extra label
+	infoLabels := map[string][]string{"databases": {"datname"}, "pools": poolLabels}
+	for collector, columns := range e.infoColumns {
+		for _, column := range columns {
+			labels := append(infoLabels[collector][:len(infoLabels[collector]):len(infoLabels[collector])], column)
+			e.newDesc(infoSubsystems[collector], column+"_info", fmt.Sprintf("always 1, %s column of show %s as label", column, collector), labels...)
+		}
+	}
+	e.newDesc("", "unique_users", "number of distinct user among pools of show pools, except pools of admin console pgbouncer")
+	e.newDesc(subsystemPool, "cl_active", "pgbouncer pool cl_active from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "cl_waiting", "pgbouncer pool cl_waiting from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "cl_cancel_req", "pgbouncer pool cl_cancel_req from show pools (1.16, 1.17)", poolLabels...)
+	e.newDesc(subsystemPool, "cl_active_cancel_req", "pgbouncer pool cl_active_cancel_req from show pools (1.18+)", poolLabels...)
+	e.newDesc(subsystemPool, "cl_waiting_cancel_req", "pgbouncer pool cl_waiting_cancel_req from show pools (1.18+)", poolLabels...)
+	e.newDesc(subsystemPool, "sv_active", "pgbouncer pool sv_active from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "sv_active_cancel", "pgbouncer pool sv_active_cancel from show pools (1.18+)", poolLabels...)
+	e.newDesc(subsystemPool, "sv_being_canceled", "pgbouncer pool sv_being_canceled from show pools (1.18+)", poolLabels...)
+	e.newDesc(subsystemPool, "sv_idle", "pgbouncer pool sv_idle from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "sv_used", "pgbouncer pool sv_used from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "sv_tested", "pgbouncer pool sv_tested from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "sv_login", "pgbouncer pool sv_login from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "maxwait", "whole seconds part of how long the oldest waiting client has waited, from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "maxwait_us", "microseconds part of maxwait (not total microseconds), total wait is maxwait + maxwait_us/1e6, from show pools", poolLabels...)
+	e.newDesc(subsystemPool, "maxwait_seconds", "how long the oldest waiting client has waited in seconds: maxwait + maxwait_us/1e6", poolLabels...)
+	e.newDesc(subsystemPool, "health", "pool health score in [0,1]: 1/((1+cl_waiting)*(1+maxwait+maxwait_us/1e6)), halved if clients waiting without idle or used servers", poolLabels...)
+	e.newDesc(subsystemPool, "idle_ratio", "sv_idle / (sv_active + sv_idle) from show pools, consistently high ratio means pool is oversized", poolLabels...)
+	e.newDesc(subsystemPool, "reserve_in_use", "whether pool server connections (sv_active+sv_idle+sv_used+sv_tested+sv_login) exceed database pool_size (default_pool_size if 0)", poolLabels...)
+	e.newDesc("", "duplicate_pool_rows_total", "duplicate (datname, user) rows of show pools that are skipped")
+	e.newDesc("server", "avg_lifetime_seconds", "average age of server connections of pool, from connect_time of show servers", poolLabels...)
+	e.waitHistogram = e.newHistogram(subsystemPool, "wait_seconds", "distribution of maxwait seconds of pools with waiting clients, observed on each scrape", prometheus.ExponentialBuckets(0.001, 4, 10))
+
+	// Peer Descriptor (pgbouncer 1.21+)
+	e.newDesc(subsystemPeer, "pool_size", "pgbouncer peer pool_size from show peers", "peer_id")
+	e.newDesc(subsystemPeerPool, "cl_active_cancel_req", "pgbouncer peer pool cl_active_cancel_req from show peer_pools", "peer_id")
+	e.newDesc(subsystemPeerPool, "cl_waiting_cancel_req", "pgbouncer peer pool cl_waiting_cancel_req from show peer_pools", "peer_id")
+	e.newDesc(subsystemPeerPool, "sv_active_cancel", "pgbouncer peer pool sv_active_cancel from show peer_pools", "peer_id")
+	e.newDesc(subsystemPeerPool, "sv_login", "pgbouncer peer pool sv_login from show peer_pools", "peer_id")
+
+	return e.checkRenames()
+}
+
+// Collect implment prometheus.Collector
+// scrape error is reported as an invalid metric, so promhttp could handle it according to ErrorHandling
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	if err := e.Scrape(ch); err != nil {
+		ch <- prometheus.NewInvalidMetric(e.Desc["pgbouncer_up"], errors.New(redactDSN(err.Error()))) // error is logged and may be served by http handler
+	}
+}
+
+// Describe implment prometheus.Collector
+// descriptors of custom collectors are included
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range e.Desc {
+		ch <- v
+	}
+	for _, c := range e.collectorList {
+		c.Describe(ch)
+	}
+}
+
+// Scrape issues query command to pgbouncer and produce metrics
+func (e *Exporter) Scrape(ch chan<- prometheus.Metric) (err error) {
+	return e.ScrapeContext(context.Background(), ch)
+}
+
+// ScrapeContext is Scrape with context, so callers could bound or cancel scrape themselves
+// collector timeouts still apply within the given context
+func (e *Exporter) ScrapeContext(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	waitStart := time.Now()
+	e.rw.Lock()
+	defer e.rw.Unlock()
+	e.queueWait = time.Since(waitStart)
+	startTime := time.Now()
+	e.heartbeats++
+	e.results = e.results[:0]
+	e.samples = 0
+	e.resets = nil
+	// inputs of derived metrics are set only by collectors that succeed in this scrape, so stale ones are never used
+	e.lists, e.config, e.poolSizes, e.poolTotals, e.activity = nil, nil, nil, nil, nil
+	if e.deltaEvery > 0 { // every deltaEvery scrapes is a full snapshot, starting from the first one
+		e.fullSnapshot = e.totalScrapes%int64(e.deltaEvery) == 0
+		if e.fullSnapshot {
+			e.lastValues = make(map[string]float64, len(e.lastValues))
+		}
+	}
+	if !e.pgbouncerUp {
+		err = e.reconnect(ctx)
+	} else if e.upOnly {
+		err = e.ping(ctx)
+	}
+	if err == nil && !e.upOnly {
+		e.sample = e.sampleWindow()
+		if e.supported == nil {
+			e.probeCommands(ctx)
+		}
+		err = e.scrapeCollectors(ctx, ch)
+	}
+
+	e.lastScrape = time.Now()
+	e.scrapeDuration = e.lastScrape.Sub(startTime)
+	e.totalScrapes++
+
+	if err != nil {
+		e.pgbouncerUp = false
+		e.errorCount++
+		if e.failures == 0 {
+			e.firstFailure = e.lastScrape
+		}
+		e.failures++
+		log.Printf("scrape failed: %s", redactDSN(err.Error()))
+	} else {
+		e.pgbouncerUp = true
+		e.failures = 0
+		e.advanceSample()
+	}
+
+	// counter reset fails the scrape after all collectors ran, pgbouncer is still reachable so no reconnect is needed
+	up := e.pgbouncerUp
+	if err == nil && e.failOnReset && len(e.resets) > 0 {
+		sort.Strings(e.resets)
+		err = fmt.Errorf("counter reset detected on databases: %s", strings.Join(e.resets, ","))
+		e.errorCount++
+		up = false
+		log.Printf("scrape failed: %s", err.Error())
+	}
+
+	// send internal metrics
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_up"], prometheus.GaugeValue, cast2Float64(up))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_duration"], prometheus.GaugeValue, cast2Float64(e.scrapeDuration))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_queue_wait_seconds"], prometheus.GaugeValue, e.queueWait.Seconds())
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_last_time"], prometheus.GaugeValue, cast2Float64(e.lastScrape))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_total"], prometheus.CounterValue, cast2Float64(e.totalScrapes))
+	if e.heartbeat {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_exporter_heartbeat_total"], prometheus.CounterValue, cast2Float64(e.heartbeats))
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_error_count"], prometheus.CounterValue, cast2Float64(e.errorCount))
+	if e.upOnly {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_timeout_seconds"], prometheus.GaugeValue, e.timeout.Seconds())
+	transport, host := connectionInfo(e.dsn)
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_connection_info"], prometheus.GaugeValue, 1, transport, host)
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_tls_insecure"], prometheus.GaugeValue, cast2Float64(e.tlsConfig != nil && e.tlsConfig.InsecureSkipVerify))
+	for k, v := range e.queryErrors {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_query_errors_total"], prometheus.CounterValue, v, k.command, k.sqlstate)
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_db_handle_recreated_total"], prometheus.CounterValue, cast2Float64(e.dbRecreated))
+	if !e.connectedAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_connection_age_seconds"], prometheus.GaugeValue, time.Since(e.connectedAt).Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_reconnects_total"], prometheus.CounterValue, cast2Float64(e.reconnects))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_config_reload_success"], prometheus.GaugeValue, cast2Float64(!e.reloadFailed))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_config_last_reload_timestamp"], prometheus.GaugeValue, float64(e.reloadedAt.Unix()))
+	if e.privilegeChecked {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_admin_privileges"], prometheus.GaugeValue, cast2Float64(e.privileged))
+	}
+	for command, supported := range e.supported {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_supported_commands"], prometheus.GaugeValue, cast2Float64(supported), command)
+	}
+	if e.sampleSize > 0 {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_sample_offset"], prometheus.GaugeValue, float64(e.sampleOffset))
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_goroutines_active"], prometheus.GaugeValue, cast2Float64(atomic.LoadInt64(&e.goroutines)))
+	for collector, last := range e.lastSuccess {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_collector_age_seconds"], prometheus.GaugeValue, time.Since(last).Seconds(), collector)
+	}
+	for _, c := range e.collectorList {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_exporter_collector_enabled"], prometheus.GaugeValue, cast2Float64(e.collectorEnabled(c)), c.Name())
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_scrape_samples"], prometheus.GaugeValue, cast2Float64(e.samples))
+
+	return err
+}
+
+// scrapeCollectors runs enabled collectors in order and stops at the first failure
+// metrics derived from multiple collectors are produced only if all of them succeeded
+func (e *Exporter) scrapeCollectors(ctx context.Context, ch chan<- prometheus.Metric) error {
+	for _, c := range e.collectorList {
+		if !e.collectorEnabled(c) {
+			continue
+		}
+		if err := e.scrapeWithTimeout(ctx, c.Name(), ch, c.Scrape); err != nil {
+			if c.Name() == "lists" { // the first command, which is where a wrong target fails
+				e.checkAdminConsole(ctx, err)
+			}
+			return err
+		}
+	}
+	e.scrapeDerived(ch)
+	return nil
+}
+
+// collectorEnabled tells whether collector is selected (WithCollectors) and enabled (e.g. peers are skipped before 1.21)
+func (e *Exporter) collectorEnabled(c Collector) bool {
+	if e.collectors != nil && !e.collectors[c.Name()] {
+		return false
+	}
+	if builtin, ok := c.(*showCollector); ok && builtin.enabled != nil {
+		return builtin.enabled()
+	}
+	return true
+}
+
+// collectorTimeout returns timeout for given collector, fallback to global timeout
+func (e *Exporter) collectorTimeout(collector string) time.Duration {
+	if timeout, exists := e.timeouts[collector]; exists && timeout > 0 {
+		return timeout
+	}
+	return e.timeout
+}
+
+// NewRegistry returns a registry dedicated to exporters (e.g. one per worker), with go runtime and process collectors registered
+// exporter metrics are wrapped with given labels, so exporters in one process never collide on registration
+func NewRegistry(labels prometheus.Labels, exporters ...*Exporter) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	for _, e := range exporters {
+		if _, err := register(prometheus.WrapRegistererWith(labels, registry), e); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range []prometheus.Collector{collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})} {
+		if _, err := register(registry, c); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// register registers c on registerer, if an equal collector is already registered, the existing one is kept and returned
+// so registering twice (e.g. when embedded in another program) is logged rather than panicking like MustRegister
+func register(registerer prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	err := registerer.Register(c)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		log.Printf("collector %T is already registered, using the existing one", c)
+		return registered.ExistingCollector, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// InstrumentGatherer registers pgbouncer_gather_duration_seconds on registry and returns a gatherer that observes it
+// gather includes collecting from pgbouncer, so exporter side overhead is roughly gather duration minus scrape duration
+func InstrumentGatherer(registry *prometheus.Registry) prometheus.Gatherer {
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pgbouncer_gather_duration_seconds",
+		Help:    "time spent on gathering all metrics of exporter, including scraping pgbouncer",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	existing, err := register(registry, duration)
+	if err != nil {
+		log.Printf("fail to register pgbouncer_gather_duration_seconds, gather is not timed: %s", err.Error())
+		return registry
+	}
+	if histogram, ok := existing.(prometheus.Histogram); ok {
+		duration = histogram
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		start := time.Now()
+		defer func() { duration.Observe(time.Since(start).Seconds()) }()
+		return registry.Gather()
+	})
+}
+
+// anonymize returns first 16 hex digits of sha256(salt + value) if label hashing is enabled, or value itself
+func (e *Exporter) anonymize(value string) string {
+	if e.hashSalt == "" {
+		return value
+	}
+	sum := sha256.Sum256([]byte(e.hashSalt + value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sampleWindow returns databases sampled in this scrape, nil means all databases (sampling disabled or unknown databases)
+func (e *Exporter) sampleWindow() map[string]bool {
+	n := len(e.sampleNames)
+	if e.sampleSize <= 0 || n == 0 || e.sampleSize >= n {
+		return nil
+	}
+	window := make(map[string]bool, e.sampleSize)
+	for i := 0; i < e.sampleSize; i++ {
+		window[e.sampleNames[(e.sampleOffset+i)%n]] = true
+	}
+	return window
+}
+
+// advanceSample moves sample window forward after a successful scrape
+func (e *Exporter) advanceSample() {
+	if n := len(e.sampleNames); e.sampleSize > 0 && n > 0 {
+		e.sampleOffset = (e.sampleOffset + e.sampleSize) % n
+	}
+}
+
+// sampled tells whether metrics of database should be emitted in this scrape
+func (e *Exporter) sampled(datname string) bool {
+	return e.sample == nil || e.sample[datname]
+}
+
+// scrapeWithTimeout run scrape function in a goroutine with the collector's own deadline, no-op if collector is not enabled
+// if deadline exceeded, builtin collectors are waited for, which return promptly as their queries run in async,
+// so they never update exporter state after this returns. other collectors keep draining in background
+func (e *Exporter) scrapeWithTimeout(ctx context.Context, collector string, ch chan<- prometheus.Metric, scrape func(context.Context, chan<- prometheus.Metric) error) (err error) {
+	if e.collectors != nil && !e.collectors[collector] {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		result := CollectorResult{Collector: collector, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			result.Error = redactDSN(err.Error())
+		} else {
+			e.lastSuccess[collector] = time.Now()
+		}
+		e.results = append(e.results, result)
+	}()
+
+	cancel := context.CancelFunc(func() {})
+	if timeout := e.collectorTimeout(collector); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	metrics, done := make(chan prometheus.Metric), make(chan error, 1)
+	atomic.AddInt64(&e.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&e.goroutines, -1)
+		done <- scrape(ctx, metrics)
+		close(metrics)
+	}()
+
+	for {
+		select {
+		case m, ok := <-metrics:
+			if !ok {
+				err := <-done
+				if err != nil {
+					e.countQueryError(collector, err)
+					if isAuthError(err) {
+						log.Print(e.authHint(collector))
+					}
+				}
+				return err
+			}
+			e.emit(ch, m)
+		case <-ctx.Done():
+			discard := func() { // discard metrics of timeout scrape until it finished
+				for range metrics {
+				}
+			}
+			if containsString(collectorGroups, collector) {
+				discard()
+			} else {
+				go discard()
+			}
+			e.countQueryError(collector, ctx.Err())
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("collector %s timeout after %v: %w", collector, e.collectorTimeout(collector), ctx.Err())
+			}
+			return fmt.Errorf("collector %s cancelled: %w", collector, ctx.Err())
+		}
+	}
+}
+
+// emit sends metric of pgbouncer to ch, and counts it as a sample of current scrape
+// value is rounded if rounding is enabled, and unchanged gauges are suppressed with delta exposition, except in full snapshot scrapes
+func (e *Exporter) emit(ch chan<- prometheus.Metric, m prometheus.Metric) {
+	if e.roundPow > 0 {
+		m = roundedMetric{Metric: m, pow: e.roundPow}
+	}
+	if e.deltaEvery > 0 && e.unchanged(m) {
+		return
+	}
+	e.samples++
+	ch <- m
+}
+
+// roundedMetric rounds value of gauge, counter & untyped metric on write, histograms & summaries are kept as is
+type roundedMetric struct {
+	prometheus.Metric
+	pow float64 // 10^decimals
+}
+
+// Write implements prometheus.Metric
+func (m roundedMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	switch {
+	case out.Gauge != nil:
+		out.Gauge.Value = roundFloat(out.Gauge.GetValue(), m.pow)
+	case out.Counter != nil:
+		out.Counter.Value = roundFloat(out.Counter.GetValue(), m.pow)
+	case out.Untyped != nil:
+		out.Untyped.Value = roundFloat(out.Untyped.GetValue(), m.pow)
+	}
+	return nil
+}
+
+// roundFloat rounds v to multiple of 1/pow, values too large to have fractional digits are kept as is (so are NaN & Inf)
+func roundFloat(v, pow float64) *float64 {
+	if scaled := v * pow; math.Abs(scaled) < 1<<53 {
+		v = math.Round(scaled) / pow
+	}
+	return &v
+}
+
+// unchanged records value of gauge series and tells whether it equals to last emitted value
+// it is always false in full snapshot scrapes, which also drop series that are gone
+func (e *Exporter) unchanged(m prometheus.Metric) bool {
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil || metric.Gauge == nil {
+		return false
+	}
+	key := m.Desc().String()
+	for _, label := range metric.Label {
+		key += "," + label.GetName() + "=" + label.GetValue()
+	}
+	value := metric.Gauge.GetValue()
+	last, exists := e.lastValues[key]
+	e.lastValues[key] = value
+	return !e.fullSnapshot && exists && (last == value || math.IsNaN(last) && math.IsNaN(value))
+}
+
+// countQueryError classify failed show command by sqlstate of *pq.Error
+func (e *Exporter) countQueryError(collector string, err error) {
+	sqlstate := "none"
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		sqlstate = string(pqErr.Code)
+	}
+	e.queryErrors[queryErrorKey{command: collector, sqlstate: sqlstate}]++
+}
+
+// authErrorPatterns are error messages returned by pgbouncer when user lacks admin or stats privileges
+var authErrorPatterns = []string{"admin access needed", "not allowed", "not authorized", "permission denied"}
+
+// isAuthError tells whether error is caused by lacking privileges on pgbouncer admin console
+func isAuthError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && (pqErr.Code == "42501" || pqErr.Code.Class() == "28") {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range authErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// authHint returns diagnostic message for authorization error, including the connected user
+func (e *Exporter) authHint(collector string) string {
+	user := "(current os user)"
+	if opts, err := parseDSN(e.dsn); err == nil && opts["user"] != "" {
+		user = opts["user"]
+	} else if env := os.Getenv("PGUSER"); env != "" {
+		user = env
+	}
+	return fmt.Sprintf("collector %s is not authorized as user %s, hint: add %s to stats_users (or admin_users) in pgbouncer.ini and reload pgbouncer", collector, user, user)
+}
+
+// probeCommands runs each optional show command once with e.query, and records whether target supports it
+// peer collectors are skipped if show peers is not supported. probe is retried on next scrape if not finished
+func (e *Exporter) probeCommands(ctx context.Context) {
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	supported := make(map[string]bool, len(probeCommands))
+	for _, command := range probeCommands {
+		err := e.query(ctx, fmt.Sprintf("SHOW %s;", strings.ToUpper(command)), func(rows *sql.Rows) error {
+			_, err := rows.Columns() // only column metadata is checked, rows are not scanned
+			return err
+		})
+		var pqErr *pq.Error
+		if err != nil && !errors.As(err, &pqErr) { // not answered by server, e.g. connection lost or timeout
+			log.Printf("probe show commands aborted: %s", err.Error())
+			return
+		}
+		supported[command] = err == nil
+	}
+	e.supported = supported
+	if !supported["peers"] {
+		e.noPeering = true
+	}
+}
+
+// checkAdminConsole logs once if target rejects show commands and does not answer `SHOW VERSION` like pgbouncer
+// it is a frequent misconfiguration that dsn points to a postgres server (e.g. port 5432) rather than pgbouncer
+func (e *Exporter) checkAdminConsole(ctx context.Context, err error) {
+	var pqErr *pq.Error
+	if e.consoleChecked || !errors.As(err, &pqErr) { // only check when server actually responds with an error
+		return
+	}
+	e.consoleChecked = true
+	var version string
+	if verr := e.DB.QueryRowContext(ctx, `SHOW VERSION;`).Scan(&version); verr != nil || !strings.Contains(strings.ToLower(version), "pgbouncer") {
+		log.Printf("target does not appear to be a PgBouncer admin console: %s, hint: connect to the pgbouncer port and the virtual database pgbouncer, e.g. postgres://stats_user@:6432/pgbouncer", pqErr.Message)
+	}
+}
+
+// scrapeShowLists fetch metrics from `SHOW LISTS`
+func (e *Exporter) scrapeShowLists(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	listResult := make(map[string]float64)
+	err = e.query(ctx, `SHOW LISTS;`, func(rows *sql.Rows) error {
+		nColumn := 2
+		columnData := make([]interface{}, nColumn)
+		scanArgs := make([]interface{}, nColumn)
+		for i := 0; i < nColumn; i++ {
+			scanArgs[i] = &columnData[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(scanArgs...); err != nil {
+				return fmt.Errorf("Error scanning rows: %w", err)
+			}
+			listResult[cast2string(columnData[0])] = cast2Float64(columnData[1])
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range listResult {
+		ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_%s", k)], prometheus.GaugeValue, v)
+	}
+	// active ratio is skipped if there is no client connection at all
+	if clients := listResult["used_clients"] + listResult["free_clients"] + listResult["login_clients"]; clients > 0 {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_clients_active_ratio"], prometheus.GaugeValue, listResult["used_clients"]/clients)
+	}
+	e.lists = listResult
+
+	return nil
+}
+
+// scrapeShowMem fetch metrics from `SHOW MEM`
+func (e *Exporter) scrapeShowMem(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	keyColumn := e.keyColumns["mem"]
+	results, err := e.queryRows(ctx, `SHOW MEM;`, keyColumn)
+	if err != nil {
+		return err
+	}
+
+	memResult := make(map[string]float64)
+	for _, row := range results {
+		name := cast2string(row[keyColumn])
+		memResult[name] = cast2Float64(row["memtotal"])
+		// prepared statement caches (max_prepared_statements, pgbouncer 1.21+) are memory pools named after them
+		if strings.Contains(name, "prepared") {
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_prepared_statements_cache_bytes"], prometheus.GaugeValue, cast2Float64(row["memtotal"]), name)
+			if used, exists := row["used"]; exists {
+				ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_prepared_statements_cache_used"], prometheus.GaugeValue, cast2Float64(used), name)
+			}
+		}
+	}
+
+	total := 0.0
+	for k, v := range memResult {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_memory_usage"], prometheus.GaugeValue, v, k)
+		if !math.IsNaN(v) {
+			total += v
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_memory_total_bytes"], prometheus.GaugeValue, total)
+	if e.memoryLimit > 0 {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_memory_limit_ratio"], prometheus.GaugeValue, total/float64(e.memoryLimit))
+	}
+	return nil
+}
+
+// scrapeShowStats fetch metrics from `SHOW STATS`
+func (e *Exporter) scrapeShowStats(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	keyColumn := e.keyColumns["stats"]
+	results, err := e.queryRows(ctx, `SHOW STATS;`, keyColumn)
+	if err != nil {
+		return err
+	}
+
+	statResult := make(map[string]map[string]float64, 5)
+	activity := make(map[string]float64, len(results))
+	network := make(map[string]float64, 2) // avg_recv & avg_sent summed over all databases
+	for _, row := range results {
+		statRow := make(map[string]float64, len(statColumns))
+		for _, column := range statColumns {
+			if v, exists := row[column]; exists {
+				statRow[column] = cast2Float64(v)
+			}
+		}
+		datname := e.anonymize(e.normalizeDatname(cast2string(row[keyColumn])))
+		if merged, exists := statResult[datname]; exists { // databases of same normalized name are summed up
+			for column, v := range statRow {
+				merged[column] += v
+			}
+			statRow = merged
+		}
+		statResult[datname] = statRow
+		activity[datname] = statRow["total_xact_count"] + statRow["total_query_count"]
+	}
+	e.activity = activity
+
+	// averages are taken from show stats_averages if supported, falling back to show stats
+	if e.supported["stats_averages"] {
+		if err := e.scrapeShowStatsAverages(ctx, statResult); err != nil {
+			log.Printf("fallback to averages of show stats: %s", err.Error())
+		}
+	}
+	for _, statRow := range statResult {
+		for _, column := range []string{"avg_recv", "avg_sent"} {
+			if v, exists := statRow[column]; exists {
+				network[column] += v
+			}
+		}
+	}
+
+	// instance throughput uses pgbouncer's own averages over stats_period (60s by default), regardless of sampling
+	if v, exists := network["avg_recv"]; exists {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_network_recv_bytes_per_second"], prometheus.GaugeValue, v)
+	}
+	if v, exists := network["avg_sent"]; exists {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_network_sent_bytes_per_second"], prometheus.GaugeValue, v)
+	}
+
+	var resets []string // databases with counter reset detected in this scrape
+	for datname, datStat := range statResult {
+		prevStat, seen := e.prevTotals[datname]
+		reset := e.detectCounterReset(datname, datStat)
+		if reset {
+			resets = append(resets, datname)
+		}
+		if !e.sampled(datname) {
+			continue
+		}
+		if e.emitDeltas {
+			for k, v := range datStat {
+				if !strings.HasPrefix(k, "total_") {
+					continue
+				}
+				delta := 0.0 // first scrape of database
+				if reset {
+					delta = v // counted from zero since reset
+				} else if seen {
+					delta = v - prevStat[k]
+				}
+				ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_stat_"+deltaName(k)], prometheus.GaugeValue, delta, datname)
+			}
+		}
+		for k, v := range datStat {
+			if strings.HasPrefix(k, "total") {
+				ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_stat_%s", k)], prometheus.CounterValue, v, datname)
+			} else {
+				ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_stat_%s", k)], prometheus.GaugeValue, v, datname)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_counter_reset_total"], prometheus.CounterValue, e.counterResets[datname], datname)
+		// queries per transaction is skipped if there is no transaction yet
+		if queries, exists := datStat["total_query_count"]; exists && datStat["total_xact_count"] > 0 {
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_stat_queries_per_xact"], prometheus.GaugeValue, queries/datStat["total_xact_count"], datname)
+		}
+	}
+	// pgbouncer does not report when stats were reset, so it is the time a reset was detected by exporter
+	if !e.statsResetAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_stats_since_reset_seconds"], prometheus.GaugeValue, time.Since(e.statsResetAt).Seconds())
+	}
+	// failure is reported by ScrapeContext once, as totals of next scrape are compared with the reset ones
+	e.resets = resets
+
+	return nil
+}
+
+// scrapeShowStatsAverages fetch averages from `SHOW STATS_AVERAGES`, and overwrite avg columns of show stats result
+// databases absent in show stats are ignored, so both commands agree on label sets
+func (e *Exporter) scrapeShowStatsAverages(ctx context.Context, statResult map[string]map[string]float64) error {
+	keyColumn := e.keyColumns["stats"]
+	results, err := e.queryRows(ctx, `SHOW STATS_AVERAGES;`, keyColumn)
+	if err != nil {
+		return err
+	}
+	averaged := make(map[string]bool, len(statResult)) // databases whose averages are overwritten
+	for _, row := range results {
+		datname := e.anonymize(e.normalizeDatname(cast2string(row[keyColumn])))
+		statRow, exists := statResult[datname]
+		if !exists {
+			continue
+		}
+		for column, avgColumn := range statAverageColumns {
+			if v, exists := row[column]; exists {
+				if averaged[datname] { // databases of same normalized name are summed up
+					statRow[avgColumn] += cast2Float64(v)
+				} else {
+					statRow[avgColumn] = cast2Float64(v)
+				}
+			}
+		}
+		averaged[datname] = true
+	}
+	return nil
+}
+
+// deltaName is the metric name (without namespace) of total_* column delta, e.g. total_xact_count -> stat_xact_delta
+func deltaName(column string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(column, "total_"), "_count") + "_delta"
+}
+
+// detectCounterReset compare total_* stats with previous scrape, and count a reset if any of them decreased
+func (e *Exporter) detectCounterReset(datname string, datStat map[string]float64) (reset bool) {
+	prevStat, exists := e.prevTotals[datname]
+	totals := make(map[string]float64, 7)
+	for k, v := range datStat {
+		if !strings.HasPrefix(k, "total") {
+			continue
+		}
+		totals[k] = v
+		if exists && v < prevStat[k] {
+			reset = true
+		}
+	}
+	e.prevTotals[datname] = totals
+	if reset {
+		e.counterResets[datname]++
+		e.statsResetAt = time.Now()
+		log.Printf("counter reset detected on database %s", datname)
+	}
+	return reset
+}
+
+// scrapeShowDatabases fetch metrics from `SHOW DATABASES`
+func (e *Exporter) scrapeShowDatabases(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	keyColumn := e.keyColumns["databases"]
+	results, err := e.queryRows(ctx, `SHOW DATABASES;`, keyColumn)
+	if err != nil {
+		return err
+	}
+	e.databaseRows = len(results) // before merging, to be compared with show lists
+	if e.datnameRegex != nil {
+		for _, row := range results {
+			row[keyColumn] = e.normalizeDatname(cast2string(row[keyColumn]))
+		}
+		results = mergeRows(results, databaseColumns, keyColumn)
+	}
+
+	poolSizes := make(map[string]float64)
+	names := make([]string, 0, len(results))
+	var paused, disabled float64
+	var userDatabases, userPaused int // databases except admin console pgbouncer
+	uniqueDatabases := make(map[string]bool, len(results))
+	for _, row := range results {
+		datname := e.anonymize(cast2string(row[keyColumn]))
+		if cast2string(row[keyColumn]) != "pgbouncer" {
+			uniqueDatabases[cast2string(row[keyColumn])] = true
+		}
+		poolSize := e.effectivePoolSize(row)
+		poolSizes[datname] = poolSize
+		names = append(names, datname)
+		if cast2Float64(row["paused"]) > 0 {
+			paused++
+		}
+		if cast2string(row[keyColumn]) != "pgbouncer" {
+			userDatabases++
+			if cast2Float64(row["paused"]) > 0 {
+				userPaused++
+			}
+		}
+		if cast2Float64(row["disabled"]) > 0 {
+			disabled++
+		}
+		e.detectBackendChange(datname, row)
+		if !e.sampled(datname) {
+			continue
+		}
+		for _, column := range databaseColumns {
+			if v, exists := row[column]; exists {
+				ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_"+column], prometheus.GaugeValue, cast2Float64(v), datname)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_backend_changed_total"], prometheus.CounterValue, e.backendChanges[datname], datname)
+		e.emitInfo(ch, "databases", row, datname)
+		if poolSize > 0 {
+			if current, exists := row["current_connections"]; exists {
+				ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_over_pool_size"], prometheus.GaugeValue, cast2Float64(cast2Float64(current) > poolSize), datname)
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_databases_paused"], prometheus.GaugeValue, paused)
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_databases_disabled"], prometheus.GaugeValue, disabled)
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_maintenance_mode"], prometheus.GaugeValue, cast2Float64(userDatabases > 0 && userPaused == userDatabases))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_unique_databases"], prometheus.GaugeValue, float64(len(uniqueDatabases)))
+	e.poolSizes = poolSizes
+	sort.Strings(names)
+	e.sampleNames = names
+	return nil
+}
+
+// effectivePoolSize returns pool_size of show databases row, where 0 means default_pool_size of show config (collected
+// earlier in the same scrape). It returns 0 if neither is known, and metrics comparing against pool size are skipped then
+func (e *Exporter) effectivePoolSize(row map[string]interface{}) float64 {
+	if poolSize := cast2Float64(row["pool_size"]); poolSize > 0 {
+		return poolSize
+	}
+	if e.config != nil {
+		if poolSize := cast2Float64(e.config["default_pool_size"]); poolSize > 0 {
+			return poolSize
+		}
+	}
+	return 0
+}
+
+// detectBackendChange compare host:port of show databases row with previous scrape, and count a change if differs
+func (e *Exporter) detectBackendChange(datname string, row map[string]interface{}) (changed bool) {
+	backend := net.JoinHostPort(cast2string(row["host"]), cast2string(row["port"]))
+	if prev, exists := e.prevBackends[datname]; exists && prev != backend {
+		changed = true
+		e.backendChanges[datname]++
+		log.Printf("backend of database %s changed from %s to %s", datname, prev, backend)
+	}
+	e.prevBackends[datname] = backend
+	return changed
+}
+
+// scrapeShowPools fetch metrics from `SHOW POOLS`
+func (e *Exporter) scrapeShowPools(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	keyColumn := e.keyColumns["pools"]
+	results, err := e.queryRows(ctx, `SHOW POOLS;`, keyColumn, "user")
+	if err != nil {
+		return err
+	}
+
+	poolTotals := make(map[string]float64, len(poolColumns))
+	seen := make(map[[2]string]bool, len(results))
+	uniqueUsers := make(map[string]bool)                     // users of all pools except admin console, regardless of filters
+	pools := make([]map[string]interface{}, 0, len(results)) // pools to be emitted
+	for _, row := range results {
+		// duplicate label set would fail the whole gather, so skip it (and its totals)
+		poolKey := [2]string{cast2string(row[keyColumn]), cast2string(row["user"])}
+		if seen[poolKey] {
+			e.duplicatePools++
+			log.Printf("duplicate pool row of database %s user %s skipped", poolKey[0], poolKey[1])
+			continue
+		}
+		seen[poolKey] = true
+		if poolKey[0] != "pgbouncer" {
+			uniqueUsers[poolKey[1]] = true
+		}
+		// instance-level totals include all pools regardless of filters, non-numeric columns are skipped
+		for column, v := range row {
+			if value := cast2Float64(v); !math.IsNaN(value) {
+				poolTotals[column] += value
+			}
+		}
+		if !e.userAllowed(cast2string(row["user"])) {
+			continue
+		}
+		// NOTICE: inactive pools will have no series (instead of zeros) when suppressZeroPools is set
+		if e.suppressZeroPools && isZeroRow(row, poolColumns) {
+			continue
+		}
+		row[keyColumn] = e.normalizeDatname(cast2string(row[keyColumn]))
+		if !e.sampled(e.anonymize(cast2string(row[keyColumn]))) {
+			continue
+		}
+		pools = append(pools, row)
+	}
+	if e.datnameRegex != nil {
+		pools = mergeRows(pools, poolColumns, keyColumn, "user")
+	}
+	if e.noUserLabel {
+		pools = mergeRows(pools, poolColumns, keyColumn)
+	}
+
+	for _, row := range pools {
+		datname := e.anonymize(cast2string(row[keyColumn]))
+		labels := []string{datname}
+		if !e.noUserLabel {
+			labels = append(labels, e.anonymize(cast2string(row["user"])))
+		}
+		for _, column := range poolColumns {
+			if v, exists := row[column]; exists {
+				ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_"+column], prometheus.GaugeValue, cast2Float64(v), labels...)
+			}
+		}
+		e.emitInfo(ch, "pools", row, labels...)
+
+		clWaiting, svAvailable := cast2Float64(row["cl_waiting"]), cast2Float64(row["sv_idle"])+cast2Float64(row["sv_used"])
+		maxwait := maxwaitSeconds(row)
+		if clWaiting > 0 && !math.IsNaN(maxwait) {
+			e.waitHistogram.Observe(maxwait)
+		}
+		if _, exists := row["maxwait"]; exists && !math.IsNaN(maxwait) {
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_maxwait_seconds"], prometheus.GaugeValue, maxwait, labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_health"], prometheus.GaugeValue, poolHealth(clWaiting, maxwait, svAvailable), labels...)
+
+		// idle ratio is skipped if there is no active or idle server
+		if svIdle, svActive := cast2Float64(row["sv_idle"]), cast2Float64(row["sv_active"]); svIdle+svActive > 0 {
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_idle_ratio"], prometheus.GaugeValue, svIdle/(svIdle+svActive), labels...)
+		}
+
+		// pool dips into reserve_pool when server connections exceed pool_size, which is per user so skipped if aggregated
+		if poolSize := e.poolSizes[datname]; poolSize > 0 && !e.noUserLabel {
+			servers := 0.0
+			for _, column := range []string{"sv_active", "sv_idle", "sv_used", "sv_tested", "sv_login"} {
+				servers += cast2Float64(row[column])
+			}
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_reserve_in_use"], prometheus.GaugeValue, cast2Float64(servers > poolSize), labels...)
+		}
+	}
+	e.poolTotals = poolTotals
+	e.poolRows = len(results)
+	ch <- e.waitHistogram
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_duplicate_pool_rows_total"], prometheus.CounterValue, cast2Float64(e.duplicatePools))
+	ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_unique_users"], prometheus.GaugeValue, float64(len(uniqueUsers)))
+	return nil
+}
+
+// mergeRows aggregates rows with same key columns into one row in order of first appearance
+// given columns are summed, except maxwait & maxwait_us which are taken from the longest waiting row,
+// and other columns (e.g. host, pool_mode) are taken from the first row
+func mergeRows(rows []map[string]interface{}, columns []string, keyColumns ...string) []map[string]interface{} {
+	merged := make(map[string]map[string]interface{}, len(rows))
+	results := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		keys := make([]string, len(keyColumns))
+		for i, column := range keyColumns {
+			keys[i] = cast2string(row[column])
+		}
+		key := strings.Join(keys, "\x00")
+		result, exists := merged[key]
+		if !exists {
+			result = make(map[string]interface{}, len(row))
+			for column, v := range row {
+				result[column] = v
+			}
+			merged[key] = result
+			results = append(results, result)
+			continue
+		}
+		for _, column := range columns {
+			if v, exists := row[column]; exists && column != "maxwait" && column != "maxwait_us" {
+				if sum, exists := result[column]; exists {
+					result[column] = cast2Float64(sum) + cast2Float64(v)
+				} else {
+					result[column] = cast2Float64(v)
+				}
+			}
+		}
+		if _, exists := row["maxwait"]; !exists {
+			continue
+		}
+		if _, exists := result["maxwait"]; !exists || maxwaitSeconds(row) > maxwaitSeconds(result) {
+			result["maxwait"] = row["maxwait"]
+			if us, exists := row["maxwait_us"]; exists {
+				result["maxwait_us"] = us
+			} else {
+				delete(result, "maxwait_us")
+			}
+		}
+	}
+	return results
+}
+
+// normalizeDatname applies -datname-regex replacement to datname, e.g. mydb_shard_0001 -> mydb_shard_N
+// admin console database pgbouncer is kept as it is
+func (e *Exporter) normalizeDatname(datname string) string {
+	if e.datnameRegex == nil || datname == "pgbouncer" {
+		return datname
+	}
+	return e.datnameRegex.ReplaceAllString(datname, e.datnameReplace)
+}
+
+// userAllowed tells whether pools of user should be scraped according to user filters
+func (e *Exporter) userAllowed(user string) bool {
+	if matchAny(e.excludeUsers, user) {
+		return false
+	}
+	return len(e.includeUsers) == 0 || matchAny(e.includeUsers, user)
+}
+
+// matchAny tells whether s matches any of glob patterns
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isZeroRow tells whether all given columns of row are zero, missing columns are ignored
+func isZeroRow(row map[string]interface{}, columns []string) bool {
+	for _, column := range columns {
+		if v, exists := row[column]; exists && cast2Float64(v) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// query runs query and passes its rows to scan in async, so collectors return as soon as ctx is done
+// while a driver call outliving ctx keeps draining in background. scan must only write its own variables,
+// exporter state is updated by collectors after query returns, so a timeout query never races the next scrape
+func (e *Exporter) query(ctx context.Context, query string, scan func(*sql.Rows) error) error {
+	db := e.DB
+	return e.async(ctx, func() error {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("Error retrieving rows: %w", err)
+		}
+		defer rows.Close()
+		return scan(rows)
+	})
+}
+
+// queryRows runs query with e.query, and returns its rows scanned by scanRows
+func (e *Exporter) queryRows(ctx context.Context, query string, keyColumns ...string) ([]map[string]interface{}, error) {
+	var results []map[string]interface{}
+	err := e.query(ctx, query, func(rows *sql.Rows) (err error) {
+		results, err = scanRows(rows, keyColumns...)
+		return err
+	})
+	if err != nil { // results may still be written by query draining in background
+		return nil, err
+	}
+	return results, nil
+}
+
+// scanRows scan rows into maps of column name -> value, so column layout differences among versions are tolerated
+// key columns must exist in result, otherwise an error is returned
+func scanRows(rows *sql.Rows, keyColumns ...string) (results []map[string]interface{}, err error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving columns: %w", err)
+	}
+	for _, keyColumn := range keyColumns {
+		found := false
+		for _, column := range columns {
+			found = found || column == keyColumn
+		}
+		if !found {
+			return nil, fmt.Errorf("key column %q not found in columns %v", keyColumn, columns)
+		}
+	}
+
+	nColumn := len(columns)
+	columnData := make([]interface{}, nColumn)
+	scanArgs := make([]interface{}, nColumn)
+	for i := 0; i < nColumn; i++ {
+		scanArgs[i] = &columnData[i]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(scanArgs...); err != nil {
+			return nil, fmt.Errorf("Error scanning rows: %w", err)
+		}
+		row := make(map[string]interface{}, nColumn)
+		for i, column := range columns {
+			row[column] = columnData[i]
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// emitInfo emits configured string columns of row as `pgbouncer_<subsystem>_<column>_info{labels..., column=value} 1`
+// columns absent in row (e.g. not in this pgbouncer version) are skipped
+func (e *Exporter) emitInfo(ch chan<- prometheus.Metric, collector string, row map[string]interface{}, labels ...string) {
+	for _, column := range e.infoColumns[collector] {
+		if v, exists := row[column]; exists {
+			values := append(labels[:len(labels):len(labels)], cast2string(v))
+			ch <- prometheus.MustNewConstMetric(e.Desc[fmt.Sprintf("pgbouncer_%s_%s_info", infoSubsystems[collector], column)], prometheus.GaugeValue, 1, values...)
+		}
+	}
+}
+
+// scrapeShowConfig fetch settings from `SHOW CONFIG`, which are used by derived metrics
+func (e *Exporter) scrapeShowConfig(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	configResult := make(map[string]string)
+	err = e.query(ctx, `SHOW CONFIG;`, func(rows *sql.Rows) error {
+		// column count varies among versions: key, value, [default,] changeable
+		columns, err := rows.Columns()
+		if err != nil {
+			return fmt.Errorf("Error retrieving columns: %w", err)
+		}
+		nColumn := len(columns)
+		if nColumn < 2 {
+			return fmt.Errorf("unexpected show config column count: %d", nColumn)
+		}
+		columnData := make([]interface{}, nColumn)
+		scanArgs := make([]interface{}, nColumn)
+		for i := 0; i < nColumn; i++ {
+			scanArgs[i] = &columnData[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(scanArgs...); err != nil {
+				return fmt.Errorf("Error scanning rows: %w", err)
+			}
+			configResult[cast2string(columnData[0])] = cast2string(columnData[1])
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	e.config = configResult
+
+	// global pool_mode as enum, 1 for the active one, an unknown mode is emitted as is
+	if mode, exists := configResult["pool_mode"]; exists {
+		for _, poolMode := range poolModes {
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_mode"], prometheus.GaugeValue, cast2Float64(poolMode == mode), poolMode)
+		}
+		if !containsString(poolModes, mode) {
+			ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_pool_mode"], prometheus.GaugeValue, 1, mode)
+		}
+	}
+	return nil
+}
+
+// pgbouncer time formats of show clients: with timezone (1.13+) or in local time (legacy)
+var pgbouncerTimeLayouts = []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05"}
+
+// errUnknownZone is returned for a zone abbreviation that is neither defined in pgbouncer time zone nor numeric
+var errUnknownZone = errors.New("unknown time zone abbreviation")
+
+// parsePgbouncerTime parse timestamp of show clients / show servers, in time zone loc of pgbouncer
+// pgbouncer formats time with strftime %Z, an abbreviation (e.g. CEST) that go resolves only if it is defined in loc,
+// otherwise it would be taken as UTC, which is off by the zone offset. so numeric ones (e.g. +03) are taken as offsets,
+// UTC and GMT are zero, and other unresolvable abbreviations are rejected with errUnknownZone
+func parsePgbouncerTime(s string, loc *time.Location) (time.Time, error) {
+	for i, layout := range pgbouncerTimeLayouts {
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err != nil {
+			continue
+		}
+		if i > 0 || t.Location() == loc || t.Location() == time.UTC {
+			return t, nil
+		}
+		name, offset := t.Zone()
+		if offset != 0 || name == "GMT" { // GMT+3 is parsed with its offset
+			return t, nil
+		}
+		if offset, ok := numericZoneOffset(name); ok {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone(name, offset)), nil
+		}
+		return time.Time{}, fmt.Errorf("%w %q in %q", errUnknownZone, name, s)
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time format %q", s)
+}
+
+// numericZoneOffset parse offset seconds of numeric zone abbreviation, e.g. +03, -0330
+func numericZoneOffset(name string) (int, bool) {
+	if len(name) != 3 && len(name) != 5 || name[0] != '+' && name[0] != '-' {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(name[1:3])
+	if err != nil {
+		return 0, false
+	}
+	minutes := 0
+	if len(name) == 5 {
+		if minutes, err = strconv.Atoi(name[3:]); err != nil {
+			return 0, false
+		}
+	}
+	offset := hours*3600 + minutes*60
+	if name[0] == '-' {
+		offset = -offset
+	}
+	return offset, true
+}
+
+// parseTime parse pgbouncer timestamp in its time zone, an unresolvable zone abbreviation is logged once
+func (e *Exporter) parseTime(s string) (time.Time, error) {
+	loc := e.location
+	if loc == nil {
+		loc = time.Local
+	}
+	t, err := parsePgbouncerTime(s, loc)
+	if errors.Is(err, errUnknownZone) && !e.zoneUnknown {
+		e.zoneUnknown = true
+		log.Printf("timestamps of pgbouncer are skipped: %s, hint: set -pgbouncer-timezone to time zone of pgbouncer, e.g. Europe/Berlin", err.Error())
+	}
+	return t, err
+}
+
+// scrapeClockSkew measure clock skew between pgbouncer and exporter with `SHOW CLIENTS`
+// pgbouncer does not expose its clock directly, but the request_time of admin console clients is updated
+// when our `SHOW CLIENTS` request arrives, so the latest one is pgbouncer's current time in 1s precision
+func (e *Exporter) scrapeClockSkew(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	requestTime := time.Now()
+	results, err := e.queryRows(ctx, `SHOW CLIENTS;`, "database", "request_time")
+	if err != nil {
+		return err
+	}
+
+	var latest time.Time
+	for _, row := range results {
+		if cast2string(row["database"]) != "pgbouncer" {
+			continue
+		}
+		if t, err := e.parseTime(cast2string(row["request_time"])); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if !latest.IsZero() {
+		skew := latest.Sub(requestTime.Truncate(time.Second)).Seconds()
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_clock_skew_seconds"], prometheus.GaugeValue, skew)
+	}
+	return nil
+}
+
+// scrapeShowServers fetch metrics from `SHOW SERVERS`, which are aggregated by pool like pool metrics
+// lifetime is measured by exporter clock, connections with unparseable connect_time are excluded
+func (e *Exporter) scrapeShowServers(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	now := time.Now()
+	results, err := e.queryRows(ctx, `SHOW SERVERS;`, "database", "user", "connect_time")
+	if err != nil {
+		return err
+	}
+
+	lifetimes := make(map[[2]string]float64) // sum of lifetime seconds by pool labels (datname, user)
+	counts := make(map[[2]string]float64)
+	for _, row := range results {
+		user := cast2string(row["user"])
+		if !e.userAllowed(user) {
+			continue
+		}
+		connectTime, err := e.parseTime(cast2string(row["connect_time"]))
+		if err != nil {
+			continue
+		}
+		datname := e.anonymize(e.normalizeDatname(cast2string(row["database"])))
+		if !e.sampled(datname) {
+			continue
+		}
+		pool := [2]string{datname, e.anonymize(user)}
+		if e.noUserLabel {
+			pool[1] = ""
+		}
+		lifetimes[pool] += now.Sub(connectTime).Seconds()
+		counts[pool]++
+	}
+	for pool, count := range counts {
+		labels := pool[:1]
+		if !e.noUserLabel {
+			labels = pool[:]
+		}
+		ch <- prometheus.MustNewConstMetric(e.Desc["pgbouncer_server_avg_lifetime_seconds"], prometheus.GaugeValue, lifetimes[pool]/count, labels...)
+	}
+	return nil
+}
+
+// scrapeShowPeers fetch metrics from `SHOW PEERS`, no-op if pgbouncer does not support peering
+func (e *Exporter) scrapeShowPeers(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	return e.scrapePeerCommand(ctx, ch, `SHOW PEERS;`, subsystemPeer, peerColumns)
+}
+
+// scrapeShowPeerPools fetch metrics from `SHOW PEER_POOLS`, no-op if pgbouncer does not support peering
+func (e *Exporter) scrapeShowPeerPools(ctx context.Context, ch chan<- prometheus.Metric) (err error) {
+	return e.scrapePeerCommand(ctx, ch, `SHOW PEER_POOLS;`, subsystemPeerPool, peerPoolColumns)
+}
+
+// peerKeyColumns are candidate key columns of peering show commands, the first present one is the peer_id label
+// show peer_pools is documented with key column database, while pgbouncer itself sends peer_id as show peers does
+var peerKeyColumns = map[string][]string{
+	subsystemPeer:     {"peer_id"},
+	subsystemPeerPool: {"peer_id", "database"},
+}
+
+// scrapePeerCommand emits metric columns of peering show command labeled by peer_id
+func (e *Exporter) scrapePeerCommand(ctx context.Context, ch chan<- prometheus.Metric, query, subsystem string, metricColumns []string) (err error) {
+	var keyColumn string
+	var results []map[string]interface{}
+	err = e.query(ctx, query, func(rows *sql.Rows) error {
+		columns, err := rows.Columns()
+		if err != nil {
+			return fmt.Errorf("Error retrieving columns: %w", err)
+		}
+		key := peerKeyColumns[subsystem][0]
+		for _, candidate := range peerKeyColumns[subsystem] {
+			if containsString(columns, candidate) {
+				key = candidate
+				break
+			}
+		}
+		keyColumn = key
+		results, err = scanRows(rows, key)
+		return err
+	})
+	if err != nil {
+		if isUnsupportedCommand(err) {
+			log.Printf("%s is not supported by pgbouncer (requires 1.21+), peer collectors are skipped until reconnect", strings.TrimSuffix(query, ";"))
+			e.noPeering = true
+			return nil
+		}
+		return err
+	}
+	for _, row := range results {
+		peerID := cast2string(row[keyColumn])
+		for _, column := range metricColumns {
+			if v, exists := row[column]; exists {
+				ch <- prometheus.MustNewConstMetric(e.Desc[prometheus.BuildFQName(namespace, subsystem, column)], prometheus.GaugeValue, cast2Float64(v), peerID)
+			}
+		}
+	}
+	return nil
+}
+
+// unsupportedCommandPatterns are error messages returned by pgbouncer for show commands it does not know
+var unsupportedCommandPatterns = []string{"invalid command", "bad show arg", "unknown"}
+
+// isUnsupportedCommand tells whether pgbouncer rejects the command as it does not exist in this version
+func isUnsupportedCommand(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	msg := strings.ToLower(pqErr.Message)
+	for _, pattern := range unsupportedCommandPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPidfile reads pid of pgbouncer from its pidfile, which is a decimal number followed by a newline
+func readPidfile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("fail to read pidfile: %w", err)
+	}
+	pid := strings.TrimSpace(string(content))
+	if n, err := strconv.Atoi(pid); err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid pid %q in pidfile %s", pid, path)
+	}
+	return pid, nil
+}
+
+// scrapeDerived produce metrics derived from multiple `SHOW` commands of current scrape
+func (e *Exporter) scrapeDerived(ch chan<- prometheus.Metric) {
+	// client connection saturation requires both show lists & show config
+	if e.lists != nil && e.config != nil {
+		maxClientConn := cast2Float64(e.config["max_client_conn"])
+		if maxClientConn > 0 {
+			saturation := (e.lists["used_clients"] + e.lists["login_clients"]) / maxClientConn
+			e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_client_connections_saturation"], prometheus.GaugeValue, saturation))
+			// pgbouncer does not count clients rejected by max_client_conn, so whether the limit is reached is a proxy of rejection
+			e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_client_limit_reached"], prometheus.GaugeValue, cast2Float64(saturation >= 1)))
+		}
+	}
+
+	// prepared statement support, absent before pgbouncer 1.21
+	if v, exists := e.config["max_prepared_statements"]; exists {
+		e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_prepared_statements_max"], prometheus.GaugeValue, cast2Float64(v)))
+	}
+
+	// pgbouncer does not report its pid in show commands, it is read from pidfile of show config if exporter shares the host
+	if path := e.config["pidfile"]; path != "" {
+		pid, err := readPidfile(path)
+		if err != nil && !e.pidUnread {
+			log.Printf("pgbouncer_process_info is skipped: %s", err.Error())
+		}
+		e.pidUnread = err != nil
+		if err == nil {
+			e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_process_info"], prometheus.GaugeValue, 1, pid))
+		}
+	}
+
+	// logins in progress requires both show lists & show pools: server logins of pools plus clients logging in
+	if e.lists != nil && e.poolTotals != nil {
+		logins := e.poolTotals["sv_login"] + e.lists["login_clients"]
+		e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_logins_in_progress"], prometheus.GaugeValue, logins))
+	}
+
+	// show lists counts disagree with enumerated rows when show commands are proxied to another pgbouncer (chained setup)
+	if e.lists != nil && e.poolTotals != nil && e.poolSizes != nil {
+		mismatch := e.lists["pools"] != float64(e.poolRows) || e.lists["databases"] != float64(e.databaseRows)
+		if mismatch && !e.mismatched {
+			log.Printf("topology mismatch: show lists reports %v databases %v pools, while show databases has %d rows and show pools has %d rows", e.lists["databases"], e.lists["pools"], e.databaseRows, e.poolRows)
+		}
+		e.mismatched = mismatch
+		e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_topology_mismatch"], prometheus.GaugeValue, cast2Float64(mismatch)))
+	}
+
+	// configured databases (show databases) without any transaction or query (show stats) since pgbouncer started
+	if e.emitUnused && e.poolSizes != nil && e.activity != nil {
+		for datname := range e.poolSizes {
+			if e.sampled(datname) {
+				e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_database_unused"], prometheus.GaugeValue, cast2Float64(e.activity[datname] == 0), datname))
+			}
+		}
+	}
+
+	// average server connections per pool, skipped if there is no pool
+	if e.lists != nil && e.poolTotals != nil && e.lists["pools"] > 0 {
+		servers := 0.0
+		for _, column := range []string{"sv_active", "sv_idle", "sv_used", "sv_tested", "sv_login"} {
+			servers += e.poolTotals[column]
+		}
+		e.emit(ch, prometheus.MustNewConstMetric(e.Desc["pgbouncer_avg_connections_per_pool"], prometheus.GaugeValue, servers/e.lists["pools"]))
+	}
+}
+
+// maxwaitSeconds combines maxwait (whole seconds) and maxwait_us (microseconds part) of show pools row
+// e.g. maxwait=3, maxwait_us=500000 is 3.5s. maxwait_us is absent before pgbouncer 1.8 and treated as 0
+// an invalid (NaN, Inf, negative) part is dropped and the valid part is used, NaN only if both are invalid
+func maxwaitSeconds(row map[string]interface{}) float64 {
+	seconds, us := cast2Float64(row["maxwait"]), 0.0
+	if v, exists := row["maxwait_us"]; exists {
+		us = cast2Float64(v)
+	}
+	validSeconds, validUs := validWait(seconds), validWait(us)
+	switch {
+	case validSeconds && validUs:
+		return seconds + us/1e6
+	case validSeconds:
+		return seconds
+	case validUs:
+		return us / 1e6
+	}
+	return math.NaN()
+}
+
+// validWait tells whether a wait time part is a finite non-negative number
+func validWait(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0) && v >= 0
+}
+
+// poolHealth calculate pool health score in [0,1] from waiting clients, max wait seconds and available servers
+// score = 1/((1+cl_waiting)*(1+maxwait)), halved if there are waiting clients but no idle or used servers
+func poolHealth(clWaiting, maxwait, svAvailable float64) float64 {
+	if math.IsNaN(clWaiting) || clWaiting < 0 {
+		clWaiting = 0
+	}
+	if math.IsNaN(maxwait) || maxwait < 0 {
+		maxwait = 0
+	}
+	score := 1 / ((1 + clWaiting) * (1 + maxwait))
+	if clWaiting > 0 && !(svAvailable > 0) {
+		score /= 2
+	}
+	return score
+}
+
+// cast2Float64 cast database driver interface{} to float64
+func cast2Float64(t interface{}) float64 {
+	switch v := t.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case time.Time:
+		return float64(v.Unix())
+	case time.Duration:
+		return float64(v.Nanoseconds())
+	case []byte:
+		strV := string(v)
+		result, err := strconv.ParseFloat(strV, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return result
+	case string:
+		result, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return result
+	case bool:
+		if v {
+			return 1.0
+		}
+		return 0.0
+	case nil:
+		return math.NaN()
+	default:
+		return math.NaN()
 	}
 }
 
@@ -441,10 +2591,921 @@ func cast2string(t interface{}) string {
 		if v {
 			return "true"
 		}
-		return "false"
+		return "false"
+	default:
+		return ""
+	}
+}
+
+// keywordDSN converts dsn in URI (postgres://...) format into keyword/value format
+func keywordDSN(dsn string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		converted, err := pq.ParseURL(dsn)
+		if err != nil {
+			return "", fmt.Errorf("invalid dsn uri: %w", err)
+		}
+		return converted, nil
+	}
+	return dsn, nil
+}
+
+// parseDSN parse dsn in either keyword/value or URI (postgres://...) format into keyword/value map
+func parseDSN(dsn string) (map[string]string, error) {
+	dsn, err := keywordDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeywordDSN(dsn)
+}
+
+// dsnWithOption returns keyword/value format dsn with given option overridden
+func dsnWithOption(dsn, key, value string) (string, error) {
+	dsn, err := keywordDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return fmt.Sprintf("%s %s='%s'", dsn, key, value), nil
+}
+
+// parseKeywordDSN parse dsn in `key=value key2='quoted value'` format
+func parseKeywordDSN(dsn string) (map[string]string, error) {
+	opts := make(map[string]string)
+	s := []rune(dsn)
+	for i := 0; i < len(s); {
+		// skip leading spaces
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		// read key until '='
+		start := i
+		for i < len(s) && s[i] != '=' && !isSpace(s[i]) {
+			i++
+		}
+		key := string(s[start:i])
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q in dsn", key)
+		}
+		i++
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+
+		// read value, which may be single quoted with backslash escapes
+		var value []rune
+		if i < len(s) && s[i] == '\'' {
+			i++
+			for ; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated quoted value of %q in dsn", key)
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				} else if s[i] == '\'' {
+					i++
+					break
+				}
+				value = append(value, s[i])
+			}
+		} else {
+			for ; i < len(s) && !isSpace(s[i]); i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value = append(value, s[i])
+			}
+		}
+		opts[key] = string(value)
+	}
+	return opts, nil
+}
+
+// isSpace tells whether rune is a dsn separator
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// connectionInfo returns transport (unix or tcp) and host of dsn, host starts with / is a unix socket directory
+func connectionInfo(dsn string) (transport, host string) {
+	opts, _ := parseDSN(dsn)
+	if host = opts["host"]; host == "" {
+		if host = os.Getenv("PGHOST"); host == "" {
+			host = "localhost"
+		}
+	}
+	if strings.HasPrefix(host, "/") {
+		return "unix", host
+	}
+	return "tcp", host
+}
+
+// socketPath returns unix socket file path of dsn, e.g. /tmp/.s.PGSQL.6432, or empty string if dsn is not using unix socket
+func socketPath(dsn string) string {
+	transport, dir := connectionInfo(dsn)
+	if transport != "unix" {
+		return ""
+	}
+	opts, _ := parseDSN(dsn)
+	port := opts["port"]
+	if port == "" {
+		if port = os.Getenv("PGPORT"); port == "" {
+			port = "5432"
+		}
+	}
+	return path.Join(dir, ".s.PGSQL."+port)
+}
+
+// validateDSN checks dsn is well-formed in either keyword/value or URI format
+func validateDSN(dsn string) error {
+	opts, err := parseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	if port, exists := opts["port"]; exists {
+		if _, err := strconv.Atoi(port); err != nil {
+			return fmt.Errorf("invalid port %q in dsn", port)
+		}
+	}
+	return nil
+}
+
+// ParsePatterns split comma separated glob patterns and validate them
+func ParsePatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ParseInfoColumns parse comma separated `collector.column` list of -info-columns, e.g. `pools.pool_mode,databases.host`
+// column is used as label name, so it must be a valid label name other than datname & user
+func ParseInfoColumns(s string) (map[string][]string, error) {
+	columns := make(map[string][]string)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		collector, column, found := strings.Cut(item, ".")
+		if _, exists := infoSubsystems[collector]; !found || !exists {
+			return nil, fmt.Errorf("invalid info column %q, should be databases.<column> or pools.<column>", item)
+		}
+		if err := validateLabelName(column); err != nil {
+			return nil, err
+		}
+		if column == "datname" || column == "user" {
+			return nil, fmt.Errorf("info column %q conflicts with label %s", item, column)
+		}
+		if !containsString(columns[collector], column) {
+			columns[collector] = append(columns[collector], column)
+		}
+	}
+	return columns, nil
+}
+
+// ParseWorkers split comma separated unix socket dirs of pgbouncer workers, glob patterns are expanded
+// e.g. `/var/run/pgbouncer-*` matches /var/run/pgbouncer-1 and /var/run/pgbouncer-2, result is sorted and deduplicated
+func ParseWorkers(s string) ([]string, error) {
+	patterns, err := ParsePatterns(s)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("worker %q should be an absolute unix socket dir", pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no worker socket dir matches %q", pattern)
+		}
+		for _, dir := range matches {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// BuildTLSConfig build tls config from arguments, returns nil if none of them is set
+// client certificate and key must be given together, server name is used for SNI and verification
+// a warning is logged if insecure is set, which skips verification of pgbouncer certificate
+func BuildTLSConfig(serverName, caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	if serverName == "" && caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+	if insecure {
+		log.Printf("WARNING: pgbouncer certificate verification is DISABLED by -tls-insecure-skip-verify, connections are open to man-in-the-middle attacks, DO NOT use it in production")
+	}
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read tls ca %s: %w", caFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificate found in tls ca %s", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls cert and tls key must be given together")
+	}
+	if certFile != "" {
+		reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+		if _, err := reloader.load(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
+
+// certReloader reads client certificate from disk on each tls handshake (i.e. each new connection)
+// so rotated certificates take effect on reconnect without restart, last good one is used if reload failed
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+}
+
+// load reads certificate & key from disk and keeps it as last good one
+func (r *certReloader) load() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load tls cert %s & key %s: %w", r.certFile, r.keyFile, err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return &cert, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := r.load()
+	if err != nil {
+		log.Printf("reload client certificate failed, using last good one: %s", err.Error())
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.cert, nil
+	}
+	return cert, nil
+}
+
+// sslRequest is postgres SSLRequest message: int32 length 8 & int32 code 80877103
+var sslRequest = []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}
+
+// tlsDialer implements pq.Dialer, it negotiates ssl with pgbouncer and wraps connection with custom tls config
+// lib/pq should use sslmode=disable with this dialer, since the connection is already encrypted
+type tlsDialer struct {
+	net.Dialer
+	config *tls.Config
+}
+
+// Dial implements pq.Dialer
+func (d *tlsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialTimeout implements pq.Dialer
+func (d *tlsDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+// DialContext implements pq.DialerContext, unix socket connection is returned as it is
+func (d *tlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil || network == "unix" {
+		return conn, err
+	}
+	tlsConn, err := d.handshake(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// handshake send SSLRequest and perform tls handshake on given connection
+func (d *tlsDialer) handshake(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if _, err := conn.Write(sslRequest); err != nil {
+		return nil, fmt.Errorf("fail to send ssl request: %w", err)
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("fail to read ssl response: %w", err)
+	}
+	if resp[0] != 'S' {
+		return nil, errors.New("pgbouncer does not support ssl")
+	}
+
+	config := d.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// GSSProvider registers GSSAPI (kerberos) provider of lib/pq, logging in with keytab & principal,
+// or with credential cache (KRB5CCNAME) if keytab is empty. It is nil unless built with `-tags gss`
+var GSSProvider func(keytab, principal string) error
+
+// GSSDSN returns dsn with kerberos service name and spn set, empty ones are left as they are
+func GSSDSN(dsn, srvName, spn string) (string, error) {
+	var err error
+	if srvName != "" {
+		if dsn, err = dsnWithOption(dsn, "krbsrvname", srvName); err != nil {
+			return "", err
+		}
+	}
+	if spn != "" {
+		if dsn, err = dsnWithOption(dsn, "krbspn", spn); err != nil {
+			return "", err
+		}
+	}
+	return dsn, nil
+}
+
+// openTLS opens *sql.DB with tlsDialer, which handles ssl instead of lib/pq
+func openTLS(dsn string, config *tls.Config) (*sql.DB, error) {
+	dsn, err := dsnWithOption(dsn, "sslmode", "disable")
+	if err != nil {
+		return nil, err
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(&tlsDialer{config: config})
+	return sql.OpenDB(connector), nil
+}
+
+// labelNameRegex is the prometheus label name rule
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateLabelName checks label name against prometheus naming rules
+func validateLabelName(name string) error {
+	if !labelNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name %q is reserved for internal use", name)
+	}
+	return nil
+}
+
+// roleRegex restricts -role to a short identifier such as primary or replica
+var roleRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// validateRole checks value of role label
+func validateRole(role string) error {
+	if !roleRegex.MatchString(role) {
+		return fmt.Errorf("invalid role %q, should match %s", role, roleRegex.String())
+	}
+	return nil
+}
+
+// labelsFlag is a repeatable `key=value` argument, implements flag.Value
+type labelsFlag prometheus.Labels
+
+// String implements flag.Value
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value
+func (l labelsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid label %q, should be key=value", s)
+	}
+	if err := validateLabelName(parts[0]); err != nil {
+		return err
+	}
+	l[parts[0]] = parts[1]
+	return nil
+}
+
+// shardFlag is a repeatable `path=group1,group2` argument, which serves given collector groups on path, implements flag.Value
+type shardFlag map[string][]string
+
+// String implements flag.Value
+func (s shardFlag) String() string {
+	pairs := make([]string, 0, len(s))
+	for k, v := range s {
+		pairs = append(pairs, k+"="+strings.Join(v, ","))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Set implements flag.Value
+func (s shardFlag) Set(arg string) error {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+		return fmt.Errorf("invalid shard %q, should be /path=group1,group2", arg)
+	}
+	groups := strings.Split(parts[1], ",")
+	for i, group := range groups {
+		groups[i] = strings.TrimSpace(group)
+		if !containsString(collectorGroups, groups[i]) {
+			return fmt.Errorf("invalid shard %q: unknown collector %q, should be one of %s", arg, groups[i], strings.Join(collectorGroups, ", "))
+		}
+	}
+	s[parts[0]] = groups
+	return nil
+}
+
+// paths returns shard paths in order, so shards are set up deterministically
+func (s shardFlag) paths() []string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// containsString tells whether s is one of list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// metricNameRegex is the prometheus metric name rule
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// renameFlag is a repeatable `old=new` metric rename argument, implements flag.Value
+type renameFlag map[string]string
+
+// String implements flag.Value
+func (r renameFlag) String() string {
+	pairs := make([]string, 0, len(r))
+	for k, v := range r {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value
+func (r renameFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !metricNameRegex.MatchString(parts[0]) || !metricNameRegex.MatchString(parts[1]) {
+		return fmt.Errorf("invalid rename %q, should be old_metric=new_metric", s)
+	}
+	r[parts[0]] = parts[1]
+	return nil
+}
+
+// ParseErrorHandling turns -error-handling argument into promhttp.HandlerErrorHandling
+func ParseErrorHandling(mode string) (promhttp.HandlerErrorHandling, error) {
+	switch mode {
+	case "continue":
+		return promhttp.ContinueOnError, nil
+	case "http500":
+		return promhttp.HTTPErrorOnError, nil
 	default:
-		return ""
+		return promhttp.ContinueOnError, fmt.Errorf("invalid error handling mode %q, should be continue or http500", mode)
+	}
+}
+
+// ListenAddress returns effective listen address, which binds to 127.0.0.1 if localhostOnly is set
+// a warning is logged if effective address binds to all interfaces
+func ListenAddress(addr string, localhostOnly bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if localhostOnly {
+		host = "127.0.0.1"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		log.Printf("warning: listen on all interfaces %s, metrics will be exposed to network, use -bind-localhost to bind 127.0.0.1 only", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// WriteMetrics gathers metrics and writes them to w in prometheus text exposition format
+// each dump starts with a `# TIMESTAMP <unix epoch ms>` comment line, and ends with an empty line
+func WriteMetrics(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		log.Printf("gather failed, partial metrics are written: %s", err.Error())
+	}
+	if _, err := fmt.Fprintf(w, "# TIMESTAMP %d\n", time.Now().UnixNano()/int64(time.Millisecond)); err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+// WriteInflux gathers metrics and writes them to w in influxdb line protocol
+// measurement is metric name, tags are labels, and field is value (count & sum for histogram and summary)
+// all points of one dump share the same timestamp in nanoseconds, NaN and Inf values are skipped
+func WriteInflux(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		log.Printf("gather failed, partial metrics are written: %s", err.Error())
+	}
+	timestamp := time.Now().UnixNano()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var fields []string
+			switch {
+			case metric.Gauge != nil:
+				fields = influxFields("value", metric.GetGauge().GetValue())
+			case metric.Counter != nil:
+				fields = influxFields("value", metric.GetCounter().GetValue())
+			case metric.Untyped != nil:
+				fields = influxFields("value", metric.GetUntyped().GetValue())
+			case metric.Histogram != nil:
+				fields = influxFields("count", float64(metric.GetHistogram().GetSampleCount()), "sum", metric.GetHistogram().GetSampleSum())
+			case metric.Summary != nil:
+				fields = influxFields("count", float64(metric.GetSummary().GetSampleCount()), "sum", metric.GetSummary().GetSampleSum())
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			line := influxEscape(family.GetName(), ", ")
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() != "" { // influx does not allow empty tag value
+					line += "," + influxEscape(label.GetName(), ", =") + "=" + influxEscape(label.GetValue(), ", =")
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s %s %d\n", line, strings.Join(fields, ","), timestamp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// influxFields renders key value pairs into line protocol fields, NaN and Inf values are skipped
+func influxFields(kvs ...interface{}) (fields []string) {
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if v := kvs[i+1].(float64); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			fields = append(fields, fmt.Sprintf("%s=%s", kvs[i], strconv.FormatFloat(v, 'g', -1, 64)))
+		}
+	}
+	return fields
+}
+
+// influxEscape escapes given special characters with backslash
+func influxEscape(s, chars string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// NativeGatherer reads metrics that pgbouncer exposes itself over http, and relabels them under our namespace as
+// pgbouncer_native_<name> (without pgbouncer_ prefix of original name), so they could be merged with exporter metrics.
+// it does not query admin console. pgbouncer_native_up is 0 if the endpoint could not be read, which is logged
+func NativeGatherer(url string, timeout time.Duration) prometheus.Gatherer {
+	client := &http.Client{Timeout: timeout}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := readNativeMetrics(client, url)
+		if err != nil {
+			log.Printf("fail to read pgbouncer metrics from %s: %s", url, err.Error())
+		}
+		name, help, value := "pgbouncer_native_up", "1 if metrics endpoint of pgbouncer (-pgbouncer-metrics-url) is read successfully", cast2Float64(err == nil)
+		up := &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: &value}}}}
+		return append(families, up), nil
+	})
+}
+
+// readNativeMetrics fetches metrics in prometheus text format from url and renames them
+func readNativeMetrics(client *http.Client, url string) ([]*dto.MetricFamily, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pgbouncer responds %s", resp.Status)
+	}
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	parsed, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for name, family := range parsed {
+		renamed := "pgbouncer_native_" + strings.TrimPrefix(name, "pgbouncer_")
+		family.Name = &renamed
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// PushInflux gathers metrics and posts them to influxdb write endpoint in line protocol
+// token from INFLUX_TOKEN environment variable is sent as `Authorization: Token <token>` if set
+func PushInflux(url string, gatherer prometheus.Gatherer) error {
+	var buf bytes.Buffer
+	if err := WriteInflux(&buf, gatherer); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token := os.Getenv("INFLUX_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influxdb responds %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// WriteMetricsPeriodically calls write every interval, until ctx is done
+func WriteMetricsPeriodically(ctx context.Context, interval time.Duration, write func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := write(); err != nil {
+			log.Printf("fail to write metrics: %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// LandingPage serves html landing page with a link to metricsURL
+func LandingPage(metricsURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.Write([]byte(`<html><head><title>Pgbouncer Exporter</title></head><body><h1>Pgbouncer Exporter</h1><p><a href='` + metricsURL + `'>Metrics</a></p></body></html>`))
+	})
+}
+
+// LegacyMetricPath is the default telemetry path of previous versions, served as an alias for compatibility
+const LegacyMetricPath = "/debug/metrics"
+
+// LegacyHandler wraps metrics handler for legacy path, a deprecation warning is logged on first hit
+func LegacyHandler(handler http.Handler) http.Handler {
+	var once sync.Once
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			log.Printf("warning: legacy metrics path %s is deprecated, please scrape %s instead", LegacyMetricPath, metricPath)
+		})
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// JSONMetric is a sample of json exposition, value is absent for NaN and Inf, while histogram and summary have count & sum
+type JSONMetric struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	Value  *float64          `json:"value,omitempty"`
+	Count  *uint64           `json:"count,omitempty"`
+	Sum    *float64          `json:"sum,omitempty"`
+}
+
+// JSONHandler renders gathered metrics as json array of JSONMetric if request accepts application/json
+// otherwise the request is served by handler in prometheus text or openmetrics format
+func JSONHandler(gatherer prometheus.Gatherer, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		families, err := gatherer.Gather()
+		if err != nil {
+			log.Printf("gather failed, partial metrics are written: %s", err.Error())
+		}
+		metrics := make([]JSONMetric, 0, len(families))
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				m := JSONMetric{Name: family.GetName(), Type: strings.ToLower(family.GetType().String()), Labels: make(map[string]string, len(metric.GetLabel()))}
+				for _, label := range metric.GetLabel() {
+					m.Labels[label.GetName()] = label.GetValue()
+				}
+				switch {
+				case metric.Gauge != nil:
+					m.Value = jsonFloat(metric.GetGauge().GetValue())
+				case metric.Counter != nil:
+					m.Value = jsonFloat(metric.GetCounter().GetValue())
+				case metric.Untyped != nil:
+					m.Value = jsonFloat(metric.GetUntyped().GetValue())
+				case metric.Histogram != nil:
+					count := metric.GetHistogram().GetSampleCount()
+					m.Count, m.Sum = &count, jsonFloat(metric.GetHistogram().GetSampleSum())
+				case metric.Summary != nil:
+					count := metric.GetSummary().GetSampleCount()
+					m.Count, m.Sum = &count, jsonFloat(metric.GetSummary().GetSampleSum())
+				}
+				metrics = append(metrics, m)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(metrics)
+	})
+}
+
+// jsonFloat returns pointer to v, or nil if v is NaN or Inf which json could not encode
+func jsonFloat(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+// WorkerScrapeHandler dispatch scrape endpoint to exporter of worker given by query parameter `worker`
+// it is ScrapeHandler of the only exporter if there is no worker
+func WorkerScrapeHandler(workers []string, exporters []*Exporter) http.Handler {
+	if len(workers) == 0 {
+		return ScrapeHandler(exporters[0])
+	}
+	handlers := make(map[string]http.Handler, len(workers))
+	for i, worker := range workers {
+		handlers[worker] = ScrapeHandler(exporters[i])
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, exists := handlers[r.URL.Query().Get("worker")]
+		if !exists {
+			http.Error(w, fmt.Sprintf("query parameter worker should be one of: %s", strings.Join(workers, ", ")), http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RegisterPprof mounts go profiling handlers under /debug/pprof/ of mux
+func RegisterPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// ParseRoutePrefix normalize route prefix into `/path` form without trailing slash, empty or `/` means no prefix
+func ParseRoutePrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
 	}
+	return prefix
+}
+
+// PrefixHandler serves handler under route prefix, paths outside the prefix are 404
+func PrefixHandler(prefix string, handler http.Handler) http.Handler {
+	if prefix == "" {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, handler))
+	return mux
+}
+
+// LimitConcurrency wraps handler with a semaphore, which bounds in-flight requests to limit
+// excess requests are rejected with 503 and Retry-After header, limit <= 0 means unlimited
+func LimitConcurrency(handler http.Handler, limit int) http.Handler {
+	return NewLimiter(limit)(handler)
+}
+
+// NewLimiter returns a wrapper that bounds in-flight requests of all handlers it wraps to limit altogether
+func NewLimiter(limit int) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(handler http.Handler) http.Handler { return handler }
+	}
+	semaphore := make(chan struct{}, limit)
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+				handler.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, fmt.Sprintf("too many concurrent scrapes, limit is %d", limit), http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// ScrapePath is the debug endpoint that triggers an out-of-band scrape
+const ScrapePath = "/-/scrape"
+
+// ScrapeReport is the json response of ScrapePath
+type ScrapeReport struct {
+	Up         bool              `json:"up"`
+	Duration   float64           `json:"duration_seconds"`
+	Error      string            `json:"error,omitempty"`
+	Collectors []CollectorResult `json:"collectors"`
+}
+
+// ScrapeHandler performs a scrape on POST and responds with per-collector timing in json, metrics are discarded
+// the scrape runs on a shadow exporter sharing the DB handle, so it has no side effect on metrics of e, e.g. stats deltas,
+// counter resets, sample window, delta exposition or scrape counters. It still waits for in-flight scrape of e to finish
+func ScrapeHandler(e *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed, use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		ch := make(chan prometheus.Metric)
+		go func() {
+			for range ch {
+			}
+		}()
+		e.rw.Lock() // serialized with scrapes of e, so pgbouncer is not queried more than usual
+		start := time.Now()
+		shadow, err := e.shadow()
+		if err == nil {
+			err = shadow.ScrapeContext(r.Context(), ch)
+			if shadow.DB != nil && shadow.DB != e.DB { // shadow connected by itself as e has not
+				shadow.DB.Close()
+			}
+		}
+		e.rw.Unlock()
+		close(ch)
+
+		report := ScrapeReport{Up: err == nil, Duration: time.Since(start).Seconds(), Collectors: shadow.results}
+		if err != nil {
+			report.Error = redactDSN(err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// shadow returns a copy of e with fresh state that shares DB handle & connection state, caller should hold e.rw
+func (e *Exporter) shadow() (*Exporter, error) {
+	shadow := NewExporter(e.dsn, e.opts...)
+	shadow.DB, shadow.pgbouncerUp, shadow.connectedAt = e.DB, e.pgbouncerUp, e.connectedAt
+	shadow.supported, shadow.noPeering, shadow.consoleChecked = e.supported, e.noPeering, e.consoleChecked
+	shadow.privileged, shadow.privilegeChecked = e.privileged, e.privilegeChecked
+	shadow.sampleNames, shadow.sampleOffset = e.sampleNames, e.sampleOffset
+	return shadow, shadow.RegisterDescriptors()
 }
 
 // ParseEnv will parse environment variable into switch variable (override arguments)
@@ -460,30 +3521,416 @@ func ParseEnv() {
 	}
 }
 
+// redacted replaces secrets in logs
+const redacted = "xxxxx"
+
+// dsn password patterns, which also match dsn embedded in text such as `parse "postgres://...": invalid port`
+var (
+	// password (and sslpassword) option of keyword/value dsn, value could be quoted
+	dsnPasswordRegex = regexp.MustCompile(`(?i)((?:^|[\s"'(])\w*password\s*=\s*)('(?:[^'\\]|\\.)*'?|[^\s"]*)`)
+	// userinfo password of URI dsn, taken up to the last @ so unescaped @ in password does not leak either
+	uriUserinfoRegex = regexp.MustCompile(`(?i)(postgres(?:ql)?://[^:/?#@\s"']*:)[^\s"']*@`)
+	// password (and sslpassword) query parameter of URI dsn
+	uriPasswordRegex = regexp.MustCompile(`(?i)([?&]\w*password=)[^&\s"']*`)
+)
+
+// redactDSN replaces passwords of dsn in either keyword/value or URI format within s, which could be a dsn or
+// a message that may contain one, e.g. connection errors, so it could be logged or exposed safely
+func redactDSN(s string) string {
+	s = uriUserinfoRegex.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = uriPasswordRegex.ReplaceAllString(s, "${1}"+redacted)
+	return dsnPasswordRegex.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactURL replaces password of url userinfo, the whole url is redacted if it could not be parsed
+func redactURL(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// logEffectiveConfig logs value of every flag after environment overrides, with dsn & url passwords and hash salt redacted
+func logEffectiveConfig(flags *flag.FlagSet) {
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "d":
+			value = redactDSN(value)
+		case "influx-url", "pgbouncer-metrics-url":
+			value = redactURL(value)
+		case "hash-salt":
+			if value != "" {
+				value = redacted
+			}
+		}
+		log.Printf("config: -%s=%q", f.Name, value)
+	})
+}
+
 func main() {
 	// parse arguements
 	flag.StringVar(&listenAddress, "l", ":9186", "Address to listen on for web interface and telemetry")
-	flag.StringVar(&metricPath, "p", "/debug/metrics", "url path under which to expose metrics")
+	flag.StringVar(&metricPath, "p", "/metrics", "url path under which to expose metrics")
+	flag.BoolVar(&legacyPath, "legacy-path", true, "also serve metrics on legacy path "+LegacyMetricPath+" (deprecated)")
+	flag.BoolVar(&timeGather, "gather-duration", true, "expose pgbouncer_gather_duration_seconds histogram of gathering metrics")
+	flag.DurationVar(&stdoutInterval, "stdout-interval", 0, "write metrics to stdout every interval instead of serving http, 0 means disabled")
+	flag.StringVar(&outputFormat, "output", "prometheus", "format of -stdout-interval mode: prometheus or influx")
+	flag.StringVar(&nativeURL, "pgbouncer-metrics-url", "", "url of metrics endpoint exposed by pgbouncer itself, merged as pgbouncer_native_* metrics, empty means disabled")
+	flag.StringVar(&influxURL, "influx-url", "", "with -output=influx, post line protocol to this influxdb write url instead of stdout")
+	flag.IntVar(&maxScrapes, "max-concurrent-scrapes", 2, "max in-flight metrics requests, excess requests get 503, 0 means unlimited")
+	flag.StringVar(&routePrefix, "route-prefix", "", "prefix of all http routes, for serving behind reverse proxy, e.g. /pgbouncer")
+	flag.BoolVar(&enablePprof, "enable-pprof", false, "serve go profiling endpoints under /debug/pprof/ for profiling exporter itself")
+	flag.BoolVar(&noLandingPage, "disable-landing-page", false, "do not serve html landing page on /, which responds 404 instead")
+	flag.BoolVar(&bindLocalhost, "bind-localhost", false, "bind http server to 127.0.0.1 with the port of listen address")
 	flag.StringVar(&dataSourceName, "d", "host=/tmp port=6432 user=pgbouncer dbname=pgbouncer sslmode=disabled", "pgbouncer dsn/url in postgres format")
+	flag.DurationVar(&scrapeTimeout, "timeout", 10*time.Second, "timeout for each collector, 0 means no timeout")
+	flag.DurationVar(&stmtTimeout, "statement-timeout", 0, "set statement_timeout of admin connection on connect in addition to -timeout, 0 means not set")
+	for _, collector := range collectorGroups {
+		collectorTimeouts[collector] = flag.Duration("timeout."+collector, 0, fmt.Sprintf("timeout for %s collector, fallback to -timeout if not set", collector))
+	}
+	for _, collector := range keyColumnCollectors {
+		keyColumnOverrides[collector] = flag.String(collector+"-key-column", "", fmt.Sprintf("advanced: column used as key label of %s collector, %s by default", collector, defaultKeyColumns[collector]))
+	}
+	flag.StringVar(&errorHandling, "error-handling", "continue", "how to respond when scrape failed: continue (http 200 with partial metrics) or http500")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "server name for tls SNI and verification, host of dsn by default")
+	flag.StringVar(&tlsCA, "tls-ca", "", "path to ca certificate that verifies pgbouncer")
+	flag.StringVar(&tlsCert, "tls-cert", "", "path to client certificate")
+	flag.StringVar(&tlsKey, "tls-key", "", "path to client private key")
+	flag.BoolVar(&tlsInsecure, "tls-insecure-skip-verify", false, "skip pgbouncer certificate verification for testing with self-signed certificates, exposes pgbouncer_tls_insecure=1")
+	flag.BoolVar(&tlsInsecure, "tls-insecure", false, "alias of -tls-insecure-skip-verify")
+	flag.BoolVar(&gssAuth, "gss", false, "authenticate with GSSAPI (kerberos) instead of password, requires exporter built with -tags gss")
+	flag.StringVar(&gssKeytab, "gss-keytab", "", "path to keytab of -gss-principal, credential cache (KRB5CCNAME) is used if not set")
+	flag.StringVar(&gssPrincipal, "gss-principal", "", "kerberos principal to login with -gss-keytab, e.g. exporter@EXAMPLE.COM")
+	flag.StringVar(&gssSrvName, "gss-srvname", "", "kerberos service name of pgbouncer, krbsrvname of dsn or postgres by default")
+	flag.StringVar(&gssSPN, "gss-spn", "", "kerberos spn of pgbouncer, takes precedence over -gss-srvname")
+	flag.StringVar(&helpFile, "help-file", "", "path to json file that overrides help text of metrics, e.g. {\"pgbouncer_up\": \"...\"}")
+	flag.Var(renameMetrics, "rename-metric", "rename metric in old=new format, repeatable")
+	flag.Var(constLabels, "const-label", "constant label attached to every metric in key=value format, repeatable")
+	flag.Var(shardPaths, "shard", "serve only given collector groups on an extra path in /path=group1,group2 format, e.g. /metrics/pools=pools, repeatable")
+	flag.BoolVar(&socketLabel, "add-socket-label", false, "attach unix socket path of dsn to every metric as constant label socket")
+	flag.StringVar(&workers, "workers", "", "comma separated unix socket dirs (or glob patterns) of pgbouncer workers with so_reuseport, each one is scraped and labeled by worker")
+	flag.BoolVar(&hashLabels, "hash-labels", false, "replace datname & user label values with salted sha256 hashes, requires -hash-salt")
+	flag.StringVar(&hashSalt, "hash-salt", "", "salt of -hash-labels, keep it secret and stable")
+	flag.StringVar(&role, "role", "", "role of pgbouncer such as primary or replica, attached to every metric as constant label role")
+	flag.StringVar(&includeUsers, "include-users", "", "comma separated glob patterns of users whose pools are scraped, all users by default")
+	flag.StringVar(&infoColumns, "info-columns", "", "comma separated string columns exposed as info metrics in collector.column format, e.g. pools.pool_mode,databases.host")
+	flag.StringVar(&excludeUsers, "exclude-users", "", "comma separated glob patterns of users whose pools are skipped, takes precedence over -include-users")
+	flag.IntVar(&watchFailures, "watchdog-failures", 5, "recreate DB handle after this many consecutive failed scrapes, 0 disables watchdog")
+	flag.DurationVar(&watchWindow, "watchdog-window", time.Minute, "recreate DB handle only if scrapes keep failing over this window")
+	flag.BoolVar(&scrapeEndpoint, "enable-scrape-endpoint", false, "serve POST "+ScrapePath+" that triggers a scrape and responds per-collector timing in json")
+	flag.StringVar(&appName, "application-name", "pgbouncer_exporter/"+Version, "application_name of connections to pgbouncer if dsn does not have one, empty means none")
+	flag.IntVar(&maxOpenConns, "max-open-conns", 1, "max open connections to pgbouncer admin console, 0 means unlimited")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 1, "max idle connections to pgbouncer admin console kept between scrapes")
+	flag.IntVar(&sampleSize, "sample-size", 0, "emit stats, databases and pools metrics of only this many databases per scrape in round-robin, 0 means all")
+	flag.BoolVar(&emitUnused, "emit-unused-databases", false, "emit pgbouncer_database_unused for databases without any traffic since pgbouncer started")
+	flag.BoolVar(&emitDeltas, "emit-deltas", false, "emit change of total stats since previous scrape as pgbouncer_stat_*_delta gauges")
+	flag.BoolVar(&failOnReset, "fail-on-counter-reset", false, "fail the scrape (pgbouncer_up = 0) when any total stats decreased since previous scrape")
+	flag.StringVar(&datnameRegex, "datname-regex", "", "regex of datname to be replaced by -datname-replacement, metrics of same normalized datname are summed up")
+	flag.StringVar(&datnameReplace, "datname-replacement", "", "replacement of -datname-regex, could refer to groups like $1, e.g. ${1}_N")
+	flag.BoolVar(&noUserLabel, "pool-no-user-label", false, "drop user label of pool metrics, pools of same database are summed up")
+	flag.Int64Var(&memoryLimit, "memory-limit", 0, "memory limit of pgbouncer in bytes, to expose pgbouncer_memory_limit_ratio, 0 means no limit")
+	flag.BoolVar(&suppressZero, "suppress-zero-pools", false, "skip metrics of pools whose counters are all zero")
+	flag.BoolVar(&enableClock, "collector.clock", false, "measure clock skew between pgbouncer and exporter with SHOW CLIENTS")
+	flag.StringVar(&pgbouncerTZ, "pgbouncer-timezone", "", "time zone of pgbouncer such as Europe/Berlin, which resolves zone abbreviations of its timestamps, exporter local time zone by default")
+	flag.BoolVar(&enableServers, "collector.servers", false, "scrape SHOW SERVERS for metrics of server connections aggregated by pool, such as average lifetime")
+	flag.BoolVar(&upOnly, "up-only", false, "liveness only: ping pgbouncer instead of show commands, exposing pgbouncer_up and scrape metrics only")
+	flag.BoolVar(&heartbeat, "heartbeat", true, "emit pgbouncer_exporter_heartbeat_total that increases on every scrape, for dead man's switch alerting")
+	flag.BoolVar(&deltaExpose, "delta-exposition", false, "experimental: suppress gauges unchanged since last scrape, incompatible with standard prometheus pull")
+	flag.IntVar(&deltaFullEvery, "delta-exposition-full-every", 10, "with -delta-exposition, emit all series every n scrapes")
+	flag.IntVar(&roundDecimals, "round-decimals", -1, "round values of pgbouncer metrics to this many decimal places, negative means no rounding")
+	flag.BoolVar(&nativeHisto, "native-histograms", false, "expose histograms as native histograms, which requires prometheus 2.40+ with native histograms enabled")
+	flag.BoolVar(&enablePeers, "collector.peers", true, "scrape SHOW PEERS and SHOW PEER_POOLS, skipped automatically before pgbouncer 1.21")
+	flag.BoolVar(&enableConfig, "collector.config", true, "scrape SHOW CONFIG for derived metrics such as client connection saturation")
 	flag.Parse()
 	ParseEnv()
+	logEffectiveConfig(flag.CommandLine)
+	errHandling, err := ParseErrorHandling(errorHandling)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validateDSN(dataSourceName); err != nil {
+		log.Fatalf("invalid data source name: %s", redactDSN(err.Error()))
+	}
+	if outputFormat != "prometheus" && outputFormat != "influx" {
+		log.Fatalf("invalid -output %q, should be prometheus or influx", outputFormat)
+	}
+	if outputFormat == "influx" && stdoutInterval <= 0 {
+		log.Fatalf("-output=influx requires -stdout-interval")
+	}
+	if hashLabels && hashSalt == "" {
+		log.Fatalf("-hash-labels requires -hash-salt, unsalted hashes of names are easy to reverse")
+	}
+	if !hashLabels {
+		hashSalt = ""
+	}
+	if deltaExpose && deltaFullEvery < 1 {
+		log.Fatalf("invalid -delta-exposition-full-every %d, should be positive", deltaFullEvery)
+	}
+	if !deltaExpose {
+		deltaFullEvery = 0
+	}
+	var datnamePattern *regexp.Regexp
+	if datnameRegex != "" {
+		if datnamePattern, err = regexp.Compile(datnameRegex); err != nil {
+			log.Fatalf("invalid -datname-regex: %s", err.Error())
+		}
+		log.Printf("datname-regex enabled: datname matching %s is replaced with %q, metrics of same normalized datname are summed up", datnameRegex, datnameReplace)
+	}
+	if memoryLimit < 0 {
+		log.Fatalf("invalid -memory-limit %d, should not be negative", memoryLimit)
+	}
+	if sampleSize < 0 {
+		log.Fatalf("invalid -sample-size %d, should not be negative", sampleSize)
+	}
+	includeUserPatterns, err := ParsePatterns(includeUsers)
+	if err != nil {
+		log.Fatalf("invalid -include-users: %s", err.Error())
+	}
+	excludeUserPatterns, err := ParsePatterns(excludeUsers)
+	if err != nil {
+		log.Fatalf("invalid -exclude-users: %s", err.Error())
+	}
+	infoColumnMap, err := ParseInfoColumns(infoColumns)
+	if err != nil {
+		log.Fatalf("invalid -info-columns: %s", err.Error())
+	}
+	if gssAuth {
+		if GSSProvider == nil {
+			log.Fatalf("-gss requires exporter built with -tags gss")
+		}
+		if (gssKeytab == "") != (gssPrincipal == "") {
+			log.Fatalf("-gss-keytab and -gss-principal must be given together")
+		}
+		if err := GSSProvider(gssKeytab, gssPrincipal); err != nil {
+			log.Fatalf("invalid gss config: %s", err.Error())
+		}
+		if dataSourceName, err = GSSDSN(dataSourceName, gssSrvName, gssSPN); err != nil {
+			log.Fatalf("invalid data source name: %s", redactDSN(err.Error()))
+		}
+	}
+	pgbouncerLocation := time.Local
+	if pgbouncerTZ != "" {
+		if pgbouncerLocation, err = time.LoadLocation(pgbouncerTZ); err != nil {
+			log.Fatalf("invalid -pgbouncer-timezone: %s", err.Error())
+		}
+	}
+	prefix := ParseRoutePrefix(routePrefix)
+	tlsConfig, err := BuildTLSConfig(tlsServerName, tlsCA, tlsCert, tlsKey, tlsInsecure)
+	if err != nil {
+		log.Fatalf("invalid tls config: %s", err.Error())
+	}
 
 	// Create new exporter
-	exporter := NewExporter(dataSourceName)
-	if err := exporter.Connect(); err != nil {
-		log.Printf("Fail to connect to pgbouncer, waiting... : %s", err.Error())
+	opts := []ExporterOpt{WithTimeout(scrapeTimeout), WithStatementTimeout(stmtTimeout)}
+	for collector, timeout := range collectorTimeouts {
+		opts = append(opts, WithCollectorTimeout(collector, *timeout))
+	}
+	for collector, column := range keyColumnOverrides {
+		opts = append(opts, WithKeyColumn(collector, *column))
+	}
+	if maxOpenConns != 1 {
+		log.Printf("max-open-conns is %d: timeout queries may still be running when next scrape starts, each connection takes a slot of pgbouncer max_client_conn", maxOpenConns)
+	}
+	opts = append(opts, WithApplicationName(appName), WithMaxConns(maxOpenConns, maxIdleConns), WithSampleSize(sampleSize), WithConfigDisabled(!enableConfig), WithTLSConfig(tlsConfig), WithZeroPoolsSuppressed(suppressZero), WithMemoryLimit(memoryLimit), WithPoolUserLabelDropped(noUserLabel), WithDatnameNormalized(datnamePattern, datnameReplace), WithClockSkew(enableClock), WithServers(enableServers), WithPgbouncerLocation(pgbouncerLocation), WithPeersDisabled(!enablePeers), WithNativeHistograms(nativeHisto), WithHeartbeat(heartbeat), WithUpOnly(upOnly), WithDeltaExposition(deltaFullEvery), WithRounding(roundDecimals), WithUnusedDatabases(emitUnused), WithDeltas(emitDeltas), WithCounterResetFailure(failOnReset), WithHashedLabels(hashSalt), WithUserFilter(includeUserPatterns, excludeUserPatterns), WithInfoColumns(infoColumnMap))
+	if deltaExpose {
+		log.Printf("delta-exposition enabled: unchanged gauges are emitted only every %d scrapes, they go stale in prometheus in between", deltaFullEvery)
+	}
+	if suppressZero {
+		log.Printf("suppress-zero-pools enabled: pools with all zero counters are not emitted, their series will have gaps instead of zeros")
+	}
+	if len(renameMetrics) > 0 {
+		opts = append(opts, WithRenames(renameMetrics))
+	}
+	if helpFile != "" {
+		helps, err := LoadHelps(helpFile)
+		if err != nil {
+			log.Fatalf("invalid -help-file: %s", err.Error())
+		}
+		opts = append(opts, WithHelps(helps))
+	}
+	if len(constLabels) > 0 {
+		opts = append(opts, WithConstLabels(prometheus.Labels(constLabels)))
+	}
+	if role != "" {
+		if err := validateRole(role); err != nil {
+			log.Fatalf("invalid -role: %s", err.Error())
+		}
+		if _, exists := constLabels["role"]; exists {
+			log.Fatalf("-role conflicts with -const-label role, use only one of them")
+		}
+		opts = append(opts, WithConstLabels(prometheus.Labels{"role": role}))
+	}
+	if _, exists := constLabels["socket"]; exists && socketLabel {
+		log.Fatalf("-add-socket-label conflicts with -const-label socket, use only one of them")
 	}
-	defer exporter.Close()
 
-	// Register prometheus descriptors
-	exporter.RegisterDescriptors()
-	prometheus.MustRegister(exporter)
-	http.Handle(metricPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		w.Write([]byte(`<html><head><title>Pgbouncer Exporter</title></head><body><h1>Pgbouncer Exporter</h1><p><a href='` + metricPath + `'>Metrics</a></p></body></html>`))
-	})
+	// one exporter per pgbouncer worker, or a single one for data source name
+	workerDirs, err := ParseWorkers(workers)
+	if err != nil {
+		log.Fatalf("invalid -workers: %s", err.Error())
+	}
+	if _, exists := constLabels["worker"]; exists && len(workerDirs) > 0 {
+		log.Fatalf("-workers conflicts with -const-label worker, use only one of them")
+	}
+	dsns := []string{dataSourceName}
+	if len(workerDirs) > 0 {
+		dsns = make([]string, len(workerDirs))
+		for i, dir := range workerDirs {
+			if dsns[i], err = dsnWithOption(dataSourceName, "host", dir); err != nil {
+				log.Fatalf("invalid data source name: %s", redactDSN(err.Error()))
+			}
+		}
+		log.Printf("scraping %d pgbouncer workers: %s", len(workerDirs), strings.Join(workerDirs, ", "))
+	}
+	newExporters := func(extra ...ExporterOpt) []*Exporter {
+		exporters := make([]*Exporter, len(dsns))
+		for i, dsn := range dsns {
+			exporterOpts := append(append([]ExporterOpt{}, opts...), extra...)
+			if len(workerDirs) > 0 {
+				exporterOpts = append(exporterOpts, WithConstLabels(prometheus.Labels{"worker": workerDirs[i]}))
+			}
+			if socketLabel {
+				if socket := socketPath(dsn); socket != "" {
+					exporterOpts = append(exporterOpts, WithConstLabels(prometheus.Labels{"socket": socket}))
+				} else {
+					log.Printf("add-socket-label ignored: data source name is not using unix socket")
+				}
+			}
+			exporter := NewExporter(dsn, exporterOpts...)
+			if err := exporter.Connect(); err != nil {
+				log.Printf("Fail to connect to pgbouncer, waiting... : %s", redactDSN(err.Error()))
+			}
+
+			// Register prometheus descriptors
+			if err := exporter.RegisterDescriptors(); err != nil {
+				log.Fatalf("fail to register descriptors: %s", err.Error())
+			}
+			exporters[i] = exporter
+		}
+		return exporters
+	}
+	exporters := newExporters()
+	for _, exporter := range exporters {
+		defer exporter.Close()
+	}
+	registry, err := NewRegistry(nil, exporters...)
+	if err != nil {
+		log.Fatalf("fail to register exporter: %s", err.Error())
+	}
+	var gatherer prometheus.Gatherer = registry
+	if timeGather {
+		gatherer = InstrumentGatherer(registry)
+	}
+	if nativeURL != "" {
+		log.Printf("merging pgbouncer metrics from %s as pgbouncer_native_*", nativeURL)
+		gatherer = prometheus.Gatherers{gatherer, NativeGatherer(nativeURL, scrapeTimeout)}
+	}
+	limit := NewLimiter(maxScrapes) // shared by metrics & scrape endpoint
+	metricHandler := limit(JSONHandler(gatherer, promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:      log.Default(),
+		ErrorHandling: errHandling,
+		Registry:      registry,
+	}))))
+	mux := http.NewServeMux() // routes are relative to route prefix
+	mux.Handle(metricPath, metricHandler)
+	if scrapeEndpoint {
+		mux.Handle(ScrapePath, limit(WorkerScrapeHandler(workerDirs, exporters)))
+	}
+	if legacyPath && metricPath != LegacyMetricPath {
+		mux.Handle(LegacyMetricPath, LegacyHandler(metricHandler))
+	}
+	if enablePprof {
+		RegisterPprof(mux)
+	}
+
+	// shards: extra paths serving only some collector groups, each with its own exporters & registry
+	watched := exporters
+	for _, shardPath := range shardPaths.paths() {
+		if shardPath == metricPath || shardPath == LegacyMetricPath || shardPath == ScrapePath {
+			log.Fatalf("invalid -shard: path %s is already in use", shardPath)
+		}
+		shardExporters := newExporters(WithCollectors(shardPaths[shardPath]))
+		for _, exporter := range shardExporters {
+			defer exporter.Close()
+		}
+		shardRegistry, err := NewRegistry(nil, shardExporters...)
+		if err != nil {
+			log.Fatalf("fail to register exporter of shard %s: %s", shardPath, err.Error())
+		}
+		mux.Handle(shardPath, limit(promhttp.InstrumentMetricHandler(shardRegistry, promhttp.HandlerFor(shardRegistry, promhttp.HandlerOpts{
+			ErrorLog:      log.Default(),
+			ErrorHandling: errHandling,
+			Registry:      shardRegistry,
+		}))))
+		watched = append(watched, shardExporters...)
+		log.Printf("serving collectors %s on %s", strings.Join(shardPaths[shardPath], ", "), prefix+shardPath)
+	}
+	if !noLandingPage { // without landing page, any path other than metrics is 404
+		mux.Handle("/", LandingPage(prefix+metricPath))
+	}
+
+	// shutdown gracefully on SIGINT & SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("received %s, shutting down", <-sig)
+		cancel()
+	}()
+
+	// reload config files on SIGHUP
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := ReloadConfig(helpFile, watched); err != nil {
+				log.Printf("reload failed, previous config is kept: %s", err.Error())
+			} else {
+				log.Printf("config reloaded")
+			}
+		}
+	}()
+
+	// watchdog runs until shutdown
+	for _, exporter := range watched {
+		go exporter.Watchdog(ctx, watchFailures, watchWindow)
+	}
+
+	// agentless mode: write metrics to stdout periodically instead of serving http
+	if stdoutInterval > 0 {
+		write := func() error { return WriteMetrics(os.Stdout, gatherer) }
+		switch {
+		case outputFormat == "influx" && influxURL != "":
+			log.Printf("Pushing metrics to influxdb %s every %v", influxURL, stdoutInterval)
+			write = func() error { return PushInflux(influxURL, gatherer) }
+		case outputFormat == "influx":
+			log.Printf("Writing metrics to stdout in influx line protocol every %v", stdoutInterval)
+			write = func() error { return WriteInflux(os.Stdout, gatherer) }
+		default:
+			log.Printf("Writing metrics to stdout every %v", stdoutInterval)
+		}
+		WriteMetricsPeriodically(ctx, stdoutInterval, write)
+		return
+	}
 
-	log.Printf("Starting Server: %s%s", listenAddress, metricPath)
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	addr, err := ListenAddress(listenAddress, bindLocalhost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: addr, Handler: PrefixHandler(prefix, mux)}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("Starting Server: %s%s%s", addr, prefix, metricPath)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }